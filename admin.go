@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+The db and leaks commands look after the database itself: upgrading it, compacting it,
+checking it, and looking at or resetting the state of the leaks.
+*/
+
+var dbCommands = []command{
+	{name: "migrate", help: "Bring the database up to date with this version of tr4ilGo: apply the pending schema migrations (the other commands do it too when they open the database) and recompute the cred hashIDs when they were made by an older version.",
+		flags: migrateFlags, run: runMigrate},
+	{name: "vacuum", help: "Rebuild the database file to give back the space of deleted rows.",
+		flags: commonFlags, run: runVacuum},
+	{name: "verify", help: "Check the integrity of the database, its foreign keys, the version and key of its hashIDs and, if it is encrypted, that every encrypted value can be decrypted. Exits with 1 if anything is wrong.",
+		flags: verifyFlags, run: runVerify},
+	{name: "rekey", help: "Change the key of an encrypted database. Only the data key is encrypted again, the rows are not touched.",
+		flags: rekeyFlags, run: runRekey},
+}
+
+var leaksCommands = []command{
+	{name: "list", help: "List the leaks of the database with their status and line counts, or with -failed the leaks that could not be read and why.",
+		flags: leaksListFlags, run: runLeaksList},
+	{name: "show", args: "<leak id>", help: "Show everything known about one leak.",
+		flags: commonFlags, run: runLeaksShow},
+	{name: "reset", args: "<leak id>...", help: "Set leaks back to new so the next ingest reads them from the top. Their sightings and rejected lines are deleted, the identities and passwords stay.",
+		flags: leaksResetFlags, run: runLeaksReset},
+}
+
+// leakStatus are the names of the status column of leaks
+var leakStatus = map[int]string{
+	1: "new",
+	2: "started",
+	3: "done",
+	4: "failed",
+}
+
+var (
+	newKeyFile  string
+	forceRehash bool
+	dryRun      bool
+	statusName  string
+	listFailed  bool
+	resetAll    bool
+)
+
+func migrateFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	hashKeyFlags(fs)
+	dbKeyFlags(fs)
+	fs.BoolVar(&forceRehash, "rehash", false, "Recompute the hashIDs even if they are up to date, eg to move the database to a new hash key")
+	fs.BoolVar(&dryRun, "dry-run", false, "Print the SQL of the pending schema migrations and exit, without changing the database")
+}
+
+func verifyFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	hashKeyFlags(fs)
+	dbKeyFlags(fs)
+}
+
+func rekeyFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	dbKeyFlags(fs)
+	fs.StringVar(&newKeyFile, "newkey", "", "File with the new key. The TR4IL_NEW_DB_KEY environment variable is used if not set, and it is asked if neither is")
+}
+
+func leaksListFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	fs.StringVar(&statusName, "status", "", "Only list the leaks with this status: new, started, done or failed")
+	fs.BoolVar(&listFailed, "failed", false, "Only list the failed leaks, with their number of tries and their error")
+}
+
+func leaksResetFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	fs.BoolVar(&resetAll, "all", false, "Reset every leak of the database")
+}
+
+func runMigrate(fs *flag.FlagSet) error {
+	db, _, err := openDBFile(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	pending, version, known, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		if !known {
+			fmt.Printf("-- %s has no schema version, its tables are version %v\n%s\n\n", *DBName, version, createSchemaVersionSQL)
+		}
+		if len(pending) == 0 {
+			fmt.Printf("-- %s is at schema version %v, no pending migration\n", *DBName, version)
+			return nil
+		}
+		fmt.Print(migrationSQL(pending))
+		return nil
+	}
+
+	applied, err := migrateDB(db)
+	if err != nil {
+		return fmt.Errorf("could not migrate %s: %s", *DBName, err)
+	}
+	if applied > 0 {
+		fmt.Printf("%s migrated from schema version %v to %v\n", *DBName, version, version+applied)
+	}
+
+	err = loadHashKey()
+	if err != nil {
+		return fmt.Errorf("could not read the hash key: %s", err)
+	}
+
+	legacy, err := legacyCreds(db)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		Logg(fmt.Sprintf("Moving the creds of %s to the normalised tables...", *DBName), "Warn")
+		n, err := convertCreds(db)
+		if err != nil {
+			return fmt.Errorf("could not move the creds: %s", err)
+		}
+		fmt.Printf("%v creds moved to the normalised tables, hashIDs are now %s\n", n, hashVersion)
+		return nil
+	}
+
+	err = checkHashVersion(db)
+	switch {
+	case err == errHashKey && !forceRehash:
+		return fmt.Errorf("%s, use -rehash to recompute the hashIDs with this key", err)
+	case err == nil && !forceRehash:
+		fmt.Printf("%s is up to date, schema version %v, hashIDs are %s\n", *DBName, version+applied, hashVersion)
+		return nil
+	}
+
+	Logg(fmt.Sprintf("Recomputing the hashIDs of %s...", *DBName), "Warn")
+	merged, err := rehashCreds(db)
+	if err != nil {
+		return fmt.Errorf("could not rehash the creds: %s", err)
+	}
+	fmt.Printf("hashIDs are now %s, %v duplicate identities and passwords were merged\n", hashVersion, merged)
+	return nil
+}
+
+func runVacuum(fs *flag.FlagSet) error {
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	before, _ := os.Stat(*DBName)
+	_, err = db.Exec("VACUUM")
+	if err != nil {
+		return err
+	}
+	after, _ := os.Stat(*DBName)
+	if before != nil && after != nil {
+		fmt.Printf("%s: %v bytes -> %v bytes\n", *DBName, before.Size(), after.Size())
+	}
+	return nil
+}
+
+func runVerify(fs *flag.FlagSet) error {
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	problems := 0
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var line string
+		rows.Scan(&line)
+		if line != "ok" {
+			fmt.Println("integrity:", line)
+			problems++
+		}
+	}
+	rows.Close()
+
+	var broken int
+	err = db.QueryRow("SELECT count(*) FROM pragma_foreign_key_check").Scan(&broken)
+	if err != nil {
+		return err
+	}
+	if broken > 0 {
+		fmt.Printf("foreign keys: %v rows point to a missing row\n", broken)
+		problems++
+	}
+
+	err = loadHashKey()
+	if err != nil {
+		return fmt.Errorf("could not read the hash key: %s", err)
+	}
+	version, err := getMetadata(db, "hash_version")
+	switch {
+	case err != nil:
+		fmt.Println("hashIDs: no version, run 'tr4ilgo db migrate'")
+		problems++
+	case version != hashVersion:
+		fmt.Printf("hashIDs: %s, this version needs %s, run 'tr4ilgo db migrate'\n", version, hashVersion)
+		problems++
+	default:
+		check, _ := getMetadata(db, "hash_key_check")
+		if check != hashKeyCheck() {
+			fmt.Println("hashIDs:", errHashKey)
+			problems++
+		}
+	}
+
+	crypt, err := openCrypt(db)
+	switch {
+	case err != nil:
+		fmt.Println("encryption:", err)
+		problems++
+	case crypt != nil:
+		bad, err := verifyEncryption(db, crypt)
+		if err != nil {
+			return err
+		}
+		if bad > 0 {
+			fmt.Printf("encryption: %v values cannot be decrypted\n", bad)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%s has %v problems", *DBName, problems)
+	}
+	fmt.Printf("%s is ok\n", *DBName)
+	return nil
+}
+
+// verifyEncryption decrypts every encrypted value of the database and returns the number that failed
+func verifyEncryption(db *sql.DB, crypt *dbCrypt) (bad int, err error) {
+	for column, query := range map[string]string{
+		"local":    "SELECT local, hashID FROM identities",
+		"password": "SELECT coalesce(password, ''), hashID FROM passwords",
+	} {
+		rows, err := db.Query(query)
+		if err != nil {
+			return bad, err
+		}
+		for rows.Next() {
+			var value, hashID string
+			err = rows.Scan(&value, &hashID)
+			if err != nil {
+				rows.Close()
+				return bad, err
+			}
+			if _, err := crypt.Decrypt(value, column, hashID); err != nil {
+				bad++
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return bad, err
+		}
+	}
+	return bad, nil
+}
+
+func runRekey(fs *flag.FlagSet) error {
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	enc, err := encrypted(db)
+	if err != nil {
+		return err
+	}
+	if !enc {
+		return fmt.Errorf("%s is not encrypted", *DBName)
+	}
+	_, err = openCrypt(db)
+	if err != nil {
+		return err
+	}
+
+	var newKey []byte
+	switch {
+	case newKeyFile != "":
+		key, err := ioutil.ReadFile(newKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not read the new key: %s", err)
+		}
+		newKey = []byte(strings.TrimSpace(string(key)))
+	case os.Getenv("TR4IL_NEW_DB_KEY") != "":
+		newKey = []byte(os.Getenv("TR4IL_NEW_DB_KEY"))
+	default:
+		newKey, err = newPassphrase()
+		if err != nil {
+			return err
+		}
+	}
+	if len(newKey) == 0 {
+		return fmt.Errorf("empty database key")
+	}
+
+	err = rekeyDB(db, newKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s has a new key\n", *DBName)
+	return nil
+}
+
+type leakInfo struct {
+	id                           int
+	name, parent, file, member   string
+	date                         string
+	lines, status                int
+	parsed, duplicates, rejected int
+	byteoffset                   int64
+	lineoffset                   int
+	failure                      string
+	attempts                     int
+}
+
+const leakInfoSQL = `SELECT id, name, parent, filename, member, date, linenumber, status,
+	parsed, duplicates, rejected, byteoffset, lineoffset, coalesce(error, ''), attempts FROM leaks`
+
+func scanLeakInfo(row interface{ Scan(...interface{}) error }) (l leakInfo, err error) {
+	var date sql.NullString
+	err = row.Scan(&l.id, &l.name, &l.parent, &l.file, &l.member, &date, &l.lines, &l.status,
+		&l.parsed, &l.duplicates, &l.rejected, &l.byteoffset, &l.lineoffset, &l.failure, &l.attempts)
+	l.date = date.String
+	return l, err
+}
+
+// path of the leak under -u, with the archive member after a '!'
+func (l leakInfo) path() string {
+	p := filepath.Join(l.parent, l.name, l.file)
+	if l.member != "" {
+		p += "!" + l.member
+	}
+	return p
+}
+
+func runLeaksList(fs *flag.FlagSet) error {
+	query := leakInfoSQL
+	args := []interface{}{}
+	if listFailed {
+		if statusName != "" && statusName != leakStatus[4] {
+			return usageError{fmt.Errorf("-failed and -status %s do not go together", statusName)}
+		}
+		statusName = leakStatus[4]
+	}
+	if statusName != "" {
+		status := 0
+		for s, name := range leakStatus {
+			if name == statusName {
+				status = s
+			}
+		}
+		if status == 0 {
+			return usageError{fmt.Errorf("unknown status %q, expecting new, started, done or failed", statusName)}
+		}
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id"
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if listFailed {
+		fmt.Fprintln(tw, "ID\tTRIES\tLINE\tLEAK\tERROR")
+	} else {
+		fmt.Fprintln(tw, "ID\tSTATUS\tLINES\tPARSED\tDUPLICATES\tREJECTED\tLEAK")
+	}
+	for rows.Next() {
+		l, err := scanLeakInfo(rows)
+		if err != nil {
+			return err
+		}
+		if listFailed {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%s\t%s\n", l.id, l.attempts, l.lineoffset, l.path(), l.failure)
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%s\t%v\t%v\t%v\t%v\t%s\n", l.id, leakStatus[l.status], l.lines, l.parsed, l.duplicates, l.rejected, l.path())
+	}
+	tw.Flush()
+	return rows.Err()
+}
+
+func runLeaksShow(fs *flag.FlagSet) error {
+	if fs.NArg() != 1 {
+		return usageError{fmt.Errorf("leaks show needs one leak id")}
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return usageError{fmt.Errorf("bad leak id %q", fs.Arg(0))}
+	}
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	l, err := scanLeakInfo(db.QueryRow(leakInfoSQL+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no leak with id %v", id)
+	}
+	if err != nil {
+		return err
+	}
+	var sightings, firsts int
+	err = db.QueryRow("SELECT count(*) FROM sightings WHERE leak = ?", id).Scan(&sightings)
+	if err != nil {
+		return err
+	}
+	err = db.QueryRow(`SELECT count(*) FROM sightings s WHERE s.leak = ? AND NOT EXISTS
+		(SELECT 1 FROM sightings f WHERE f.identity = s.identity AND f.password = s.password AND f.id < s.id)`, id).Scan(&firsts)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "id\t%v\n", l.id)
+	fmt.Fprintf(tw, "leak\t%s\n", l.path())
+	fmt.Fprintf(tw, "added\t%s\n", l.date)
+	fmt.Fprintf(tw, "status\t%s\n", leakStatus[l.status])
+	fmt.Fprintf(tw, "lines\t%v\n", l.lines)
+	fmt.Fprintf(tw, "parsed\t%v\n", l.parsed)
+	fmt.Fprintf(tw, "duplicates\t%v\n", l.duplicates)
+	fmt.Fprintf(tw, "rejected\t%v\n", l.rejected)
+	fmt.Fprintf(tw, "checkpoint\tline %v, byte %v\n", l.lineoffset, l.byteoffset)
+	if l.attempts > 0 {
+		fmt.Fprintf(tw, "failed tries\t%v\n", l.attempts)
+		fmt.Fprintf(tw, "last error\t%s\n", l.failure)
+	}
+	fmt.Fprintf(tw, "creds seen\t%v\n", sightings)
+	fmt.Fprintf(tw, "creds first seen\t%v\n", firsts)
+
+	rows, err := db.Query("SELECT reason, count(*) FROM rejects WHERE leak = ? GROUP BY reason ORDER BY 2 DESC", id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reason string
+		var n int
+		rows.Scan(&reason, &n)
+		fmt.Fprintf(tw, "rejects %s\t%v\n", reason, n)
+	}
+	tw.Flush()
+	return rows.Err()
+}
+
+/*
+runLeaksReset puts the leaks back as if they were never read. Their sightings are
+deleted, so a cred only seen in them is gone until the next ingest reads them again. The
+identities and passwords stay: other leaks might have them too.
+*/
+func runLeaksReset(fs *flag.FlagSet) error {
+	var ids []interface{}
+	for _, arg := range fs.Args() {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return usageError{fmt.Errorf("bad leak id %q", arg)}
+		}
+		ids = append(ids, id)
+	}
+	if resetAll == (len(ids) > 0) {
+		return usageError{fmt.Errorf("leaks reset needs leak ids or -all")}
+	}
+
+	where := "1"
+	if !resetAll {
+		where = "%s IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	}
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	steps := []string{
+		"DELETE FROM sightings WHERE " + strings.Replace(where, "%s", "leak", 1),
+		"DELETE FROM rejects WHERE " + strings.Replace(where, "%s", "leak", 1),
+		"UPDATE leaks SET status = 1, parsed = 0, duplicates = 0, rejected = 0, byteoffset = 0, lineoffset = 0, error = NULL, attempts = 0 WHERE " + strings.Replace(where, "%s", "id", 1),
+	}
+	var n int64
+	for _, step := range steps {
+		res, err := tx.Exec(step, ids...)
+		if err != nil {
+			return err
+		}
+		n, _ = res.RowsAffected()
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v leaks reset\n", n)
+	return nil
+}
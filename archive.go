@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+/*
+Leaks often ship compressed (.gz, .bz2, .xz, .zst) or archived (.zip, .tar, .tar.gz...).
+Nothing is extracted on disk: the file is opened and the decompression is streamed
+straight into the parser. The format is found with the magic bytes of the file and
+not with its extension, so a renamed or extensionless dump is still read correctly.
+Each member of an archive becomes its own leak job (dirStruct.member).
+*/
+
+const (
+	leakPlain = "plain"
+	leakZip   = "zip"
+	leakTar   = "tar"
+)
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicBzip2 = []byte("BZh")
+	magicXz    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicZip   = []byte("PK\x03\x04")
+	magicTar   = []byte("ustar")
+)
+
+type archiveMember struct {
+	name  string // path of the member inside the archive
+	lines int    // number of lines in the member, -1 if it could not be read
+}
+
+// stream is a decompressed reader along with everything that needs closing once done
+type stream struct {
+	*bufio.Reader
+	closers []func() error
+}
+
+func (s *stream) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if e := s.closers[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// decompress peeks at the first bytes of s and, if they match a known compression,
+// replaces the reader by the decompressed one. It loops so that a .gz of a .bz2 works too.
+func (s *stream) decompress() error {
+	for {
+		head, _ := s.Peek(6)
+		var r io.Reader
+		switch {
+		case bytes.HasPrefix(head, magicGzip):
+			gz, err := gzip.NewReader(s.Reader)
+			if err != nil {
+				return err
+			}
+			s.closers = append(s.closers, gz.Close)
+			r = gz
+		case bytes.HasPrefix(head, magicBzip2):
+			r = bzip2.NewReader(s.Reader)
+		case bytes.HasPrefix(head, magicXz):
+			x, err := xz.NewReader(s.Reader)
+			if err != nil {
+				return err
+			}
+			r = x
+		case bytes.HasPrefix(head, magicZstd):
+			zs, err := zstd.NewReader(s.Reader)
+			if err != nil {
+				return err
+			}
+			s.closers = append(s.closers, func() error { zs.Close(); return nil })
+			r = zs
+		default:
+			return nil
+		}
+		s.Reader = bufio.NewReaderSize(r, 64*1024)
+	}
+}
+
+// isTar checks the "ustar" magic at offset 257 of the (decompressed) stream
+func (s *stream) isTar() bool {
+	head, _ := s.Peek(262)
+	return len(head) == 262 && bytes.Equal(head[257:262], magicTar)
+}
+
+// openStream opens the file at filePath and returns it decompressed
+func openStream(filePath string) (*stream, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	s := &stream{Reader: bufio.NewReaderSize(file, 64*1024), closers: []func() error{file.Close}}
+	err = s.decompress()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// leakKind tells if the file is a zip, a (possibly compressed) tar or a plain (possibly compressed) file
+func leakKind(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, len(magicZip))
+	n, _ := io.ReadFull(file, head)
+	file.Close()
+	if bytes.Equal(head[:n], magicZip) {
+		return leakZip, nil
+	}
+
+	s, err := openStream(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+	if s.isTar() {
+		return leakTar, nil
+	}
+	return leakPlain, nil
+}
+
+/*
+listMembers goes through the archive once and returns the regular files in it, with
+their number of lines. Tar archives have no index so the whole archive is streamed, we
+might as well count the lines at the same time. Members are filtered with -i / -x.
+*/
+func listMembers(filePath, kind string) ([]archiveMember, error) {
+	var members []archiveMember
+
+	count := func(name string, r io.Reader) {
+		m := archiveMember{name: name, lines: -1}
+		s := &stream{Reader: bufio.NewReaderSize(r, 64*1024)}
+		err := s.decompress()
+		if err == nil {
+			m.lines, err = LineCounter(s)
+		}
+		s.Close()
+		CheckErr(err, "Warn", fmt.Sprintf("Could not count lines of %s in %s", name, filePath))
+		members = append(members, m)
+	}
+
+	switch kind {
+	case leakZip:
+		z, err := zip.OpenReader(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		for _, f := range z.File {
+			if f.FileInfo().IsDir() || !keepMember(f.Name) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				CheckErr(err, "Warn", fmt.Sprintf("Could not open %s in %s", f.Name, filePath))
+				continue
+			}
+			count(f.Name, rc)
+			rc.Close()
+		}
+
+	case leakTar:
+		s, err := openStream(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer s.Close()
+		tr := tar.NewReader(s)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return members, err
+			}
+			if hdr.Typeflag != tar.TypeReg || !keepMember(hdr.Name) {
+				continue
+			}
+			count(hdr.Name, tr)
+		}
+
+	default:
+		return nil, fmt.Errorf("%s is not an archive", filePath)
+	}
+
+	return members, nil
+}
+
+// keepMember tells if the member name of an archive is read, with -i / -x
+func keepMember(name string) bool {
+	base := path.Base(name)
+	if matchAny(splitPatterns(*Exclude), base, name) {
+		return false
+	}
+	include := splitPatterns(*Include)
+	return len(include) == 0 || matchAny(include, base, name)
+}
+
+/*
+openLeak opens the file of the job and returns the decompressed content of the file,
+or of the archive member if job.member is set. For tar archives we have to stream
+through the archive up to the member.
+*/
+func openLeak(job dirStruct) (io.ReadCloser, error) {
+	filePath := filepath.Join(job.path, job.file)
+
+	if job.member == "" {
+		return openStream(filePath)
+	}
+
+	kind, err := leakKind(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case leakZip:
+		z, err := zip.OpenReader(filePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range z.File {
+			if f.Name != job.member {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				z.Close()
+				return nil, err
+			}
+			s := &stream{Reader: bufio.NewReaderSize(rc, 64*1024), closers: []func() error{z.Close, rc.Close}}
+			err = s.decompress()
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			return s, nil
+		}
+		z.Close()
+
+	case leakTar:
+		s, err := openStream(filePath)
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(s)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				s.Close()
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if hdr.Name != job.member {
+				continue
+			}
+			m := &stream{Reader: bufio.NewReaderSize(tr, 64*1024), closers: []func() error{s.Close}}
+			err = m.decompress()
+			if err != nil {
+				m.Close()
+				return nil, err
+			}
+			return m, nil
+		}
+
+	default:
+		return nil, fmt.Errorf("%s is not an archive, cannot open member %s", filePath, job.member)
+	}
+
+	return nil, fmt.Errorf("member %s not found in %s", job.member, filePath)
+}
+
+/*
+openLeakAt is openLeak starting at offset bytes in the decompressed content. A plain
+uncompressed file is seeked, anything else has to be decompressed up to the offset.
+*/
+func openLeakAt(job dirStruct, offset int64) (io.ReadCloser, error) {
+	if job.member == "" {
+		file, err := os.Open(filepath.Join(job.path, job.file))
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, 6)
+		n, _ := file.ReadAt(head, 0)
+		if !compressed(head[:n]) {
+			_, err = file.Seek(offset, io.SeekStart)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			return &stream{Reader: bufio.NewReaderSize(file, 64*1024), closers: []func() error{file.Close}}, nil
+		}
+		file.Close()
+	}
+
+	r, err := openLeak(job)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(ioutil.Discard, r, offset)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("could not skip to byte %v: %s", offset, err)
+	}
+	return r, nil
+}
+
+// compressed tells if head starts with the magic bytes of a compression we know
+func compressed(head []byte) bool {
+	for _, magic := range [][]byte{magicGzip, magicBzip2, magicXz, magicZstd} {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+expandArchives replaces every archive in the job list by one job per member. Plain
+files are kept as they are, their lines are counted when they are added to the db.
+
+An archive is only listed the first time it is seen: its members are then in the leaks
+table and the next ingests take them from there, so an archive that is done (or half
+done) is not decompressed all over again just to find what is in it.
+*/
+func expandArchives(jobs []dirStruct, store Store) []dirStruct {
+	var expanded []dirStruct
+
+	for _, j := range jobs {
+		filePath := filepath.Join(j.path, j.file)
+		j.lines = -1
+
+		kind, err := leakKind(filePath)
+		if err != nil {
+			CheckErr(err, "Error", fmt.Sprint("Could not read file:", filePath))
+			continue
+		}
+		if kind == leakPlain {
+			expanded = append(expanded, j)
+			continue
+		}
+
+		members, err := store.ArchiveMembers(j.parent, j.name, j.file)
+		CheckErr(err, "Warn", fmt.Sprint("Could not read the members of the archive from the db, listing it:", filePath))
+		if err != nil || len(members) == 0 {
+			Logg(fmt.Sprintf("Listing %s archive %s", kind, filePath), "Info")
+			members, err = listMembers(filePath, kind)
+			CheckErr(err, "Error", fmt.Sprint("Could not list archive:", filePath))
+		}
+		for _, m := range members {
+			if !keepMember(m.name) {
+				continue
+			}
+			member := j
+			member.member = m.name
+			member.lines = m.lines
+			expanded = append(expanded, member)
+		}
+	}
+
+	return expanded
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+/*
+ingest -bulk is the fast path for the big first loads into SQLite. Most of the time of a
+normal ingest goes in the UNIQUE indexes: every cred is two lookups and up to three
+inserts in the hashID and domain indexes, at random places of B-trees larger than the
+cache. With -bulk:
+
+  - the connections run with journal_mode=WAL, synchronous=OFF and a large cache_size
+    (bulkPragmas): a commit no longer waits for the disk, but a power loss or a crash
+    of the OS can corrupt the database, not only lose its last transactions. A crash
+    of tr4ilGo itself is safe, the checkpoints read the lost batches again. Only bulk
+    load a database you can delete and load again
+  - the creds go to bulk_sightings as they are, a table without any index, and the
+    UNIQUE indexes are left alone until the end of the load
+  - a transaction holds -bulktx batches of -b records, not one batch or one leak
+  - at the end of the load (mergeBulkLoad) the staged creds are moved to domains,
+    identities, passwords and sightings with one INSERT ... SELECT each, so the indexes
+    are filled in one go. When the load is bigger than what the database had, the
+    secondary indexes are dropped for the merge and built again after it
+  - the UNIQUE indexes (domain, hashID, identity/password/leak) stay: they are
+    constraints of the tables, which would have to be made again without them, and the
+    ON CONFLICT of the merge needs them to dedupe against what the database had. Each
+    INSERT ... SELECT is ordered by the key of its UNIQUE index instead, so the new keys
+    come in the order of the index and go to the pages next to the last ones, not to a
+    random page of a B-tree larger than the cache
+
+The duplicates of a leak are only known once merged, they are added to its counts then.
+The leaks are marked done as they are read, and their checkpoints saved with the staged
+creds, so a load that was stopped resumes like any other: the next ingest merges what
+was staged before. The other commands refuse a database with staged creds.
+*/
+
+// bulkDriver is the SQLite driver of ingest -bulk, its connections start with bulkPragmas
+const bulkDriver = "sqlite3_bulk"
+
+var bulkPragmas = []string{
+	"PRAGMA journal_mode = WAL",
+	"PRAGMA synchronous = OFF",
+	"PRAGMA cache_size = -524288", // KiB, 512MB
+}
+
+// bulkIndexes are the indexes that are not needed for the merge, dropped for the big ones
+var bulkIndexes = map[string]string{
+	"identities_domain": "CREATE INDEX IF NOT EXISTS identities_domain ON identities(domain_id)",
+	"sightings_leak":    "CREATE INDEX IF NOT EXISTS sightings_leak ON sightings(leak)",
+}
+
+func init() {
+	sql.Register(bulkDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range bulkPragmas {
+				_, err := conn.Exec(pragma, nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// sqliteDriver is the driver openDBFile opens the database with
+func sqliteDriver() string {
+	if *BulkLoad {
+		return bulkDriver
+	}
+	return "sqlite3"
+}
+
+// stagedCreds returns the number of creds in bulk_sightings, waiting for mergeBulkLoad
+func stagedCreds(db execer) (n int, err error) {
+	err = db.QueryRow("SELECT count(*) FROM bulk_sightings").Scan(&n)
+	return n, err
+}
+
+/*
+mergeBulkLoad moves the creds of bulk_sightings to their tables, in one transaction. The
+first row of an identity or a password (in the order they were read) is the one kept,
+and a cred is a duplicate when it was already in the database or comes again in the
+staged creds: the same as the writer does one cred at a time.
+*/
+func mergeBulkLoad(db *sql.DB) error {
+	staged, err := stagedCreds(db)
+	if err != nil || staged == 0 {
+		return err
+	}
+	Logg(fmt.Sprintf("Merging the %v creds of the bulk load", staged), "Info")
+	start := time.Now()
+
+	var sightings int
+	err = db.QueryRow("SELECT coalesce(max(id), 0) FROM sightings").Scan(&sightings)
+	if err != nil {
+		return err
+	}
+	rebuild := staged > sightings
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if rebuild {
+		for name := range bulkIndexes {
+			_, err = tx.Exec("DROP INDEX IF EXISTS " + name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the WHERE 1 are there for the parser, an INSERT ... SELECT ... ON CONFLICT needs one
+	steps := []string{
+		"INSERT OR IGNORE INTO domains(domain) SELECT DISTINCT domain FROM bulk_sightings WHERE domain <> '' ORDER BY domain",
+		// in the order of the hashIDs, the first one read of the same hashID is kept
+		`INSERT INTO identities(hashID, local, domain_id)
+			SELECT b.identity_hash, b.local, d.id FROM bulk_sightings b LEFT JOIN domains d ON d.domain = b.domain
+			WHERE 1 ORDER BY b.identity_hash, b.id ON CONFLICT(hashID) DO NOTHING`,
+		`INSERT INTO passwords(hashID, password)
+			SELECT password_hash, password FROM bulk_sightings WHERE 1 ORDER BY password_hash, id ON CONFLICT(hashID) DO NOTHING`,
+		`CREATE TEMP TABLE bulk_ids AS
+			SELECT b.id AS id, b.leak AS leak, i.id AS identity, p.id AS password FROM bulk_sightings b
+			JOIN identities i ON i.hashID = b.identity_hash
+			JOIN passwords p ON p.hashID = b.password_hash`,
+	}
+	for _, step := range steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			return err
+		}
+	}
+
+	duplicates := map[int]int{}
+	rows, err := tx.Query(`SELECT leak, count(*) FROM (
+			SELECT t.leak AS leak, row_number() OVER (PARTITION BY t.identity, t.password ORDER BY t.id) AS k,
+			EXISTS (SELECT 1 FROM sightings s WHERE s.identity = t.identity AND s.password = t.password) AS known
+			FROM bulk_ids t)
+		WHERE known OR k > 1 GROUP BY leak`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var leak, n int
+		err = rows.Scan(&leak, &n)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates[leak] = n
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	steps = []string{
+		`INSERT INTO sightings(identity, password, leak, line, url, firstSeen)
+			SELECT t.identity, t.password, b.leak, b.line, b.url, b.firstSeen FROM bulk_ids t JOIN bulk_sightings b ON b.id = t.id
+			WHERE 1 ORDER BY t.identity, t.password, b.leak, t.id ON CONFLICT DO NOTHING`,
+		"DROP TABLE bulk_ids",
+		"DELETE FROM bulk_sightings",
+	}
+	for _, step := range steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			return err
+		}
+	}
+	for leak, n := range duplicates {
+		_, err = tx.Exec("UPDATE leaks SET duplicates = duplicates + ? WHERE id = ?", n, leak)
+		if err != nil {
+			return err
+		}
+	}
+	for _, create := range bulkIndexes {
+		_, err = tx.Exec(create)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	Logg(fmt.Sprintf("Bulk load merged in %s", time.Since(start)), "Info")
+	return nil
+}
+
+// bulkTx is the StoreTx of ingest -bulk, it only appends the creds to bulk_sightings
+type bulkTx struct {
+	*sqliteTx
+}
+
+func (s *sqliteStore) beginBulk() (StoreTx, error) {
+	t, err := s.beginSQLite()
+	if err != nil {
+		return nil, err
+	}
+	return &bulkTx{sqliteTx: t}, nil
+}
+
+// WriteCreds stages the creds, their duplicates are counted by mergeBulkLoad
+func (t *bulkTx) WriteCreds(creds []record) (map[int]int, error) {
+	return map[int]int{}, countBusy(insertStaged(t.tx, creds))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// -r deletes the WAL of a bulk load with the database, or it would be replayed into the new one
+func TestRemoveDB(t *testing.T) {
+	testConfig(t, "-bulk")
+	path := filepath.Join(t.TempDir(), "creds.db")
+	store := testOpenStore(t, path)
+	testLeak(t, store, "dump.txt")
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("no %s to delete: %s", p, err)
+		}
+	}
+
+	err := removeDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", p, err)
+		}
+	}
+	err = removeDB(path)
+	if err != nil {
+		t.Errorf("deleting a database that is not there: %s", err)
+	}
+
+	if n := testCount(t, testOpenStore(t, path), "leaks"); n != 0 {
+		t.Errorf("%v leaks in the new database, want none", n)
+	}
+}
+
+// testTables is what the ingest made of the dumps: the sightings by hashIDs, file and line, and the counts of the leaks
+func testTables(t testing.TB, store Store) []string {
+	t.Helper()
+	var got []string
+	for _, query := range []string{
+		`SELECT i.hashID || ' ' || p.hashID || ' ' || p.password || ' ' || l.filename || ':' || s.line FROM sightings s
+			JOIN identities i ON i.id = s.identity JOIN passwords p ON p.id = s.password JOIN leaks l ON l.id = s.leak`,
+		"SELECT filename || ' ' || duplicates || ' ' || status FROM leaks",
+		"SELECT 'domain ' || domain FROM domains",
+	} {
+		rows, err := store.Meta().Query(query + " ORDER BY 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var row string
+			err = rows.Scan(&row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, row)
+		}
+		rows.Close()
+	}
+	return got
+}
+
+// the merge of -bulk makes the same tables and counts the same duplicates as the normal ingest
+func TestBulkSameAsNormal(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "leaks", "merge")
+	err := os.MkdirAll(dir, 0750)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a@x.com:pw1\nb@x.com:pw2\na@x.com:pw1\nc@Y.com:pw1\n"), 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("a@x.com:pw1\nd@y.com:pw3\nb@x.com:other\nd@y.com:pw3\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tables [2][]string
+	for i, args := range [][]string{nil, {"-bulk"}} {
+		testConfig(t, append([]string{"-u", root, "-p", "leaks", "-w", "1"}, args...)...)
+		store := testStore(t)
+		testIngest(t, context.Background(), store)
+		err = store.FinishLoad()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables[i] = testTables(t, store)
+	}
+	if len(tables[0]) != 6+2+2 {
+		t.Errorf("normal ingest made %v rows, want 6 sightings, 2 leaks and 2 domains: %q", len(tables[0]), tables[0])
+	}
+	if strings.Join(tables[0], "\n") != strings.Join(tables[1], "\n") {
+		t.Errorf("-bulk made\n%s\nwant, as the normal ingest\n%s", strings.Join(tables[1], "\n"), strings.Join(tables[0], "\n"))
+	}
+}
+
+/*
+BenchmarkIngest loads the same synthetic dump with and without -bulk, into a new database
+every time. The dump is TR4IL_BENCH_LINES lines (100000 by default) in 10 files, eg
+TR4IL_BENCH_LINES=10000000 go test -run XXX -bench Ingest -benchtime 1x -timeout 0
+for the 10 million lines of a real first load (the numbers of the README were made so).
+*/
+func BenchmarkIngest(b *testing.B) {
+	lines := 100000
+	if s := os.Getenv("TR4IL_BENCH_LINES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 10 {
+			b.Fatalf("TR4IL_BENCH_LINES=%q, want a number of lines of 10 or more", s)
+		}
+		lines = n
+	}
+	root := b.TempDir()
+	var size int64
+	for i := 0; i < 10; i++ {
+		size += testDump(b, filepath.Join(root, "leaks", "bench"), "dump"+strconv.Itoa(i)+".txt", lines/10)
+	}
+
+	for _, mode := range []struct {
+		name string
+		args []string
+	}{
+		{"normal", nil},
+		{"bulk", []string{"-bulk"}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				testConfig(b, append([]string{"-u", root, "-p", "leaks", "-w", "4"}, mode.args...)...)
+				store := testOpenStore(b, filepath.Join(b.TempDir(), "creds.db"))
+				b.StartTimer()
+
+				testIngest(b, context.Background(), store)
+				err := store.FinishLoad()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				if n := testCount(b, store, "sightings"); n != lines/10*10 {
+					b.Fatalf("%v sightings, want %v", n, lines/10*10)
+				}
+				store.Close()
+			}
+			b.ReportMetric(float64(lines/10*10*b.N)/b.Elapsed().Seconds(), "lines/s")
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+tr4ilGo is run as "tr4ilgo <command> [options]". Every command has its own flag set, which
+starts with the common flags (-config, -d, -v), see config.go. The db and leaks commands
+have subcommands of their own ("tr4ilgo db vacuum").
+
+Exit codes: 0 when all went well, 1 when the command failed, 2 for a bad command line,
+130 when it was stopped by SIGINT or SIGTERM.
+*/
+
+const (
+	exitOK          = 0
+	exitError       = 1
+	exitUsage       = 2
+	exitInterrupted = 130
+)
+
+// errInterrupted is returned by a command that was stopped by a signal, see interruptContext
+var errInterrupted = errors.New("interrupted")
+
+// usageError is returned by the commands when the command line is wrong, it exits with exitUsage
+type usageError struct {
+	err error
+}
+
+// errPrinted is a usage error the flag package already printed along with the usage
+var errPrinted = errors.New("bad options")
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+type command struct {
+	name  string
+	args  string // what comes after the options in the usage line
+	help  string
+	flags func(fs *flag.FlagSet)
+	run   func(fs *flag.FlagSet) error
+	sub   []command // subcommands, flags and run are not used when set
+}
+
+var commands = []command{
+	{name: "ingest", help: "Read the leak files under -u/-p into the database. Leaks already read are skipped, leaks that were stopped in the middle are resumed.",
+		flags: ingestFlags, run: runIngest},
+	{name: "search", help: "Look for the creds of an email or of a domain.",
+		flags: searchFlags, run: runSearch},
+	{name: "stats", help: "Print the numbers of the database and its top domains.",
+		flags: statsFlags, run: runStats},
+	{name: "export", help: "Write the creds of the database as email:password lines.",
+		flags: exportFlags, run: runExport},
+	{name: "db", help: "Maintenance of the database file.", sub: dbCommands},
+	{name: "leaks", help: "List, show and reset the leaks of the database.", sub: leaksCommands},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command of the args and returns the exit code
+func run(args []string) int {
+	// before the subcommands, the options went straight after the program name
+	if len(args) > 0 && strings.HasPrefix(args[0], "-") && !isHelp(args[0]) {
+		args = append([]string{"ingest"}, args...)
+	}
+
+	err := runCommand("tr4ilgo", commands, args)
+	defer closeLogFile()
+	var usage usageError
+	switch {
+	case err == nil, err == flag.ErrHelp:
+		return exitOK
+	case errors.As(err, &usage):
+		if usage.err != errPrinted {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+		return exitUsage
+	case err == errInterrupted:
+		return exitInterrupted
+	default:
+		CheckErr(err, "Error", "Command failed")
+		return exitError
+	}
+}
+
+func isHelp(arg string) bool {
+	switch arg {
+	case "help", "-h", "-help", "--help":
+		return true
+	}
+	return false
+}
+
+// runCommand finds the command named args[0] in cmds, parses its flags and runs it
+func runCommand(prog string, cmds []command, args []string) error {
+	if len(args) == 0 {
+		printCommands(prog, cmds)
+		return usageError{fmt.Errorf("%s needs a command", prog)}
+	}
+	if isHelp(args[0]) {
+		printCommands(prog, cmds)
+		return flag.ErrHelp
+	}
+
+	var cmd *command
+	for i := range cmds {
+		if cmds[i].name == args[0] {
+			cmd = &cmds[i]
+		}
+	}
+	if cmd == nil {
+		printCommands(prog, cmds)
+		return usageError{fmt.Errorf("unknown command %q", args[0])}
+	}
+	name := prog + " " + cmd.name
+	if cmd.sub != nil {
+		return runCommand(name, cmd.sub, args[1:])
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s\n\n%s\n\nOptions:\n", strings.TrimSpace(name+" [options] "+cmd.args), cmd.help)
+		fs.PrintDefaults()
+	}
+	cmd.flags(fs)
+
+	err := loadConfig(fs, args[1:])
+	if err != nil {
+		return usageError{err}
+	}
+	err = fs.Parse(args[1:])
+	switch {
+	case err == flag.ErrHelp:
+		return err
+	case err != nil:
+		return usageError{errPrinted}
+	}
+	err = setupLogging()
+	if err != nil {
+		return usageError{err}
+	}
+
+	return cmd.run(fs)
+}
+
+/*
+interruptContext returns a context cancelled by the first SIGINT or SIGTERM, for the
+commands that can stop cleanly (ingest). The second signal exits at once. stop releases
+the signals, it has to be called once the command is over.
+*/
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			Logg(fmt.Sprintf("Got %s, stopping after the lines being written. Again to stop at once", sig), "Warn")
+			cancel()
+		case <-stopped:
+			return
+		}
+		select {
+		case <-signals:
+			// what was not committed is read again from the checkpoints next time
+			Logg("Stopped at once", "Warn")
+			os.Exit(exitInterrupted)
+		case <-stopped:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(stopped)
+		cancel()
+	}
+}
+
+func printCommands(prog string, cmds []command) {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", prog)
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", prog)
+}
+
+func setLogLevel() {
+	switch {
+	case *LogLevel == "":
+		log.SetLevel(log.WarnLevel)
+		LogLvl = "Warning"
+	case *LogLevel == "v":
+		log.SetLevel(log.InfoLevel)
+		LogLvl = "Info"
+	case *LogLevel == "vv":
+		log.SetLevel(log.DebugLevel)
+		log.SetReportCaller(true)
+		LogLvl = "Debug"
+		go func() {
+			log.Println(http.ListenAndServe("localhost:6060", nil))
+		}()
+	}
+}
+
+/*
+openDB opens the -d database. If it does not exist it is created with its tables when
+create is set, otherwise it is an error: the commands reading the database should not
+leave an empty file behind. The pending migrations are applied, and the key of an
+encrypted database is loaded too, if given. A database with creds still to be moved to
+the normalised tables (see convertCreds) is refused, only db migrate can open it, and so
+is one with the staged creds of a bulk load when it is not for an ingest (see bulk.go).
+*/
+func openDB(create bool) (*sql.DB, error) {
+	db, created, err := openDBFile(create)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		err = CreateTable(db)
+		if err == nil {
+			err = checkBatchWriters(db)
+		}
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not create tables: %s", err)
+		}
+		return db, nil
+	}
+	_, err = migrateDB(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate %s: %s", *DBName, err)
+	}
+	err = checkBatchWriters(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s does not have the tables of this version: %s", *DBName, err)
+	}
+	legacy, err := legacyCreds(db)
+	if err == nil && legacy {
+		err = fmt.Errorf("the creds of %s are in the tables of an older version, run 'tr4ilgo db migrate' to move them", *DBName)
+	}
+	if err == nil && !create {
+		staged, e := stagedCreds(db)
+		if e == nil && staged > 0 {
+			e = fmt.Errorf("%s has %v creds of a bulk load that was stopped, run 'tr4ilgo ingest' to finish it", *DBName, staged)
+		}
+		err = e
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDBFile is openDB without the migrations, created tells if the file is new
+func openDBFile(create bool) (db *sql.DB, created bool, err error) {
+	if isPostgres(*DBName) {
+		return nil, false, fmt.Errorf("%s is a PostgreSQL database, this command only works on SQLite", *DBName)
+	}
+	if _, err := os.Stat(*DBName); os.IsNotExist(err) {
+		if !create {
+			return nil, false, fmt.Errorf("database %s does not exist", *DBName)
+		}
+		Logg(fmt.Sprintf("Database does not exist - creating %s...", *DBName), "Warn")
+
+		file, err := os.Create(*DBName) // Create SQLite file
+		if err != nil {
+			return nil, false, fmt.Errorf("could not create database file: %s", err)
+		}
+		file.Close()
+		created = true
+	}
+
+	err = loadDBKey()
+	if err != nil {
+		return nil, false, fmt.Errorf("could not read the database key: %s", err)
+	}
+	db, err = sql.Open(sqliteDriver(), sqliteDSN(*DBName))
+	return db, created, err
+}
+
+// sqliteBusyTimeout is how long SQLite waits for the lock of another process
+var sqliteBusyTimeout = 5 * time.Second
+
+// sqliteBusyRetries is the times a transaction is begun again when SQLite was busy for all of sqliteBusyTimeout
+const sqliteBusyRetries = 3
+
+/*
+sqliteDSN is the data source name of the SQLite file at path. SQLite waits
+sqliteBusyTimeout for the locks of other processes before it returns busy, and the
+transactions take the write lock when they begin (they all write): a transaction that
+gets busy gets it before it wrote anything, so it can be begun again (see beginSQLite).
+*/
+func sqliteDSN(path string) string {
+	return fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate", path, sqliteBusyTimeout.Milliseconds())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Config holds the settings of tr4ilGo. Every subcommand has its own flags, but they all
+write in this one struct, and the rest of the code reads it through the pointers below
+(*DBName, *Path...). Before the flags, the settings are read from a config file, given
+with -config or the TR4IL_CONFIG environment variable, so the flags win over the file.
+
+The config file has one "key = value" per line, '#' starts a comment. The keys are the
+long names of configKeys (db, path, parent, workers, batch...) or the flag names.
+*/
+type Config struct {
+	DBName    string
+	Path      string
+	Parent    string
+	NWorkers  int
+	BatchSize int
+	CleanDB   bool
+	LogLevel  string
+
+	LogFormat  string
+	LogFile    string
+	LogMaxSize int
+	LogBackups int
+
+	Include        string
+	Exclude        string
+	MaxDepth       int
+	FollowSymlinks bool
+
+	Format          string
+	FormatOverrides string
+	SplitOn         string
+	Rejects         string
+	MaxLineLength   int
+
+	HashKeyFile    string
+	PasswordPolicy string
+	EncryptDB      bool
+	DBKeyFile      string
+
+	Parquet string
+
+	BulkLoad bool
+	BulkTx   int
+
+	Retries     int
+	RetryFailed bool
+
+	Metrics string
+}
+
+var config Config
+
+var (
+	DBName    = &config.DBName
+	Path      = &config.Path
+	Parent    = &config.Parent
+	NWorkers  = &config.NWorkers
+	BatchSize = &config.BatchSize
+	CleanDB   = &config.CleanDB
+	LogLevel  = &config.LogLevel
+
+	LogFormat  = &config.LogFormat
+	LogFile    = &config.LogFile
+	LogMaxSize = &config.LogMaxSize
+	LogBackups = &config.LogBackups
+
+	Include        = &config.Include
+	Exclude        = &config.Exclude
+	MaxDepth       = &config.MaxDepth
+	FollowSymlinks = &config.FollowSymlinks
+
+	Format          = &config.Format
+	FormatOverrides = &config.FormatOverrides
+	SplitOn         = &config.SplitOn
+	Rejects         = &config.Rejects
+	MaxLineLength   = &config.MaxLineLength
+
+	HashKeyFile    = &config.HashKeyFile
+	PasswordPolicy = &config.PasswordPolicy
+	EncryptDB      = &config.EncryptDB
+	DBKeyFile      = &config.DBKeyFile
+
+	Parquet = &config.Parquet
+
+	BulkLoad = &config.BulkLoad
+	BulkTx   = &config.BulkTx
+
+	Retries     = &config.Retries
+	RetryFailed = &config.RetryFailed
+
+	Metrics = &config.Metrics
+)
+
+// configKeys are the long names that can be used in the config file for the short flags
+var configKeys = map[string]string{
+	"db":       "d",
+	"path":     "u",
+	"parent":   "p",
+	"workers":  "w",
+	"batch":    "b",
+	"verbose":  "v",
+	"include":  "i",
+	"exclude":  "x",
+	"symlinks": "L",
+}
+
+// commonFlags are the flags of every subcommand
+func commonFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "Config file with one 'key = value' per line. The TR4IL_CONFIG environment variable is used if not set")
+	fs.StringVar(DBName, "d", "creds.db", "Name of the database: a SQLite file, or a postgres:// URL for ingest and search")
+	fs.StringVar(LogLevel, "v", "", "Log level [default: WARN | v: INFO | vv: DEBUG ]")
+	fs.StringVar(LogFormat, "logformat", logText, "Format of the logs: text (coloured on a terminal), logfmt or json")
+	fs.StringVar(LogFile, "logfile", "", "File where to also write the logs, as logfmt or json, it is rotated when it gets too big")
+	fs.IntVar(LogMaxSize, "logsize", logFileMB, "Size in MB at which the -logfile is rotated")
+	fs.IntVar(LogBackups, "logkeep", 5, "Number of rotated log files kept, 0 keeps them all")
+}
+
+// hashKeyFlags are the flags of the subcommands that compute hashIDs
+func hashKeyFlags(fs *flag.FlagSet) {
+	fs.StringVar(HashKeyFile, "hashkey", "", "File with the key of the cred hashIDs (HMAC-SHA256). The TR4IL_HASH_KEY environment variable is used if not set")
+}
+
+// dbKeyFlags are the flags of the subcommands reading or writing the encrypted columns
+func dbKeyFlags(fs *flag.FlagSet) {
+	fs.StringVar(DBKeyFile, "dbkey", "", "File with the key of an encrypted database. The TR4IL_DB_KEY environment variable is used if not set, and it is asked if neither is")
+}
+
+func ingestFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	hashKeyFlags(fs)
+	dbKeyFlags(fs)
+	fs.BoolVar(EncryptDB, "encrypt", false, "Encrypt the emails and passwords of a new database with the -dbkey key, it needs a hash key (-hashkey). A database encrypted once stays encrypted")
+	fs.StringVar(Path, "u", "/media/parrot/HASHDB", "Path where the raw leak files are.")
+	fs.IntVar(NWorkers, "w", 50, "Number of workers to go scan files. Each worker will scrap one text file at a time.")
+	fs.StringVar(Parent, "p", "Collection 1", "Name of the parent directory")
+	fs.BoolVar(CleanDB, "r", false, "Delets the database, with its -wal and -shm files, to start fresh. NO RETURN")
+	fs.IntVar(BatchSize, "b", 1000, "Batch size when inserting to database. The workers send what they read to a single writer, which commits its transaction every time this many records were written.")
+
+	fs.StringVar(Include, "i", "", "Comma separated glob patterns of the files to ingest, eg '*.txt,*.csv'. Patterns with a '/' are matched on the path relative to the parent directory. Empty means every file.")
+	fs.StringVar(Exclude, "x", "", "Comma separated glob patterns of the files and directories to skip.")
+	fs.IntVar(MaxDepth, "depth", 0, "Maximum depth to walk under the parent directory. 0 means no limit.")
+	fs.BoolVar(FollowSymlinks, "L", false, "Follow symbolic links when walking the leak directory.")
+
+	fs.StringVar(Rejects, "rejects", "", "Where to keep the lines that could not be read: '' (nowhere), 'table' (rejects table) or the path of a directory with one file per leak")
+	fs.IntVar(MaxLineLength, "maxline", 1024, "Lines longer than this are rejected as too-long")
+
+	fs.StringVar(Format, "format", "auto", "Format of the lines in the leak files, 'auto' guesses it for each file from its first lines. Formats: email:pass, user:pass, email;pass, tsv, csv, url:email:pass")
+	fs.StringVar(SplitOn, "split", "first", "Where to split login and password when the password has the separator in it: 'first' separator after the email, or 'last' separator of the line")
+	fs.StringVar(PasswordPolicy, "passwords", passwordPlaintext, "How the passwords are stored: plaintext, sha1, ntlm, sha256 (digests), hmac (keyed with the hash key) or mask (first and last characters). A database keeps the policy of its first ingest")
+	fs.BoolVar(BulkLoad, "bulk", false, "Bulk load, for the big first loads into SQLite: the creds are staged without indexes and merged at the end, with WAL, synchronous=OFF and a large cache. A power loss or a crash of the OS can corrupt the database, only use it for a database you can load again")
+	fs.IntVar(BulkTx, "bulktx", 100, "With -bulk, number of batches of -b records in a transaction")
+	fs.StringVar(Parquet, "parquet", "", "Directory where to also write the creds to a Parquet file, a new one for every ingest")
+	fs.IntVar(Retries, "retries", 3, "Number of times a leak that could not be read is tried again, waiting longer every time, before it is set to failed")
+	fs.BoolVar(RetryFailed, "retry-failed", false, "Also read the failed leaks again (see 'leaks list -failed'), from where they stopped")
+	fs.StringVar(Metrics, "metrics", "", "Address where to serve the Prometheus metrics of the ingest on /metrics, eg 'localhost:9100'. Not served if empty")
+	fs.StringVar(FormatOverrides, "formats", "", "Comma separated pattern=format pairs forcing the format of the files matching the glob pattern, eg '*.csv=csv,stealer/*=url:email:pass'")
+}
+
+/*
+loadConfig sets the flags of fs from the config file, if there is one. It is called
+before fs.Parse(args) so the command line wins. The keys of the file that are not flags
+of this subcommand are skipped, the file is shared by all of them.
+*/
+func loadConfig(fs *flag.FlagSet, args []string) error {
+	path := configPath(args)
+	if path == "" {
+		return nil
+	}
+	return loadConfigFile(fs, path)
+}
+
+// configPath looks for -config in the args, before they are parsed
+func configPath(args []string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name := strings.TrimLeft(a, "-")
+		if len(name) == len(a) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, "config="):
+			return strings.TrimPrefix(name, "config=")
+		case name == "config" && i+1 < len(args):
+			return args[i+1]
+		}
+	}
+	return os.Getenv("TR4IL_CONFIG")
+}
+
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%v: expecting key = value", path, lineNum)
+		}
+		key := strings.TrimSpace(kv[0])
+		value := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+
+		name := key
+		if short, ok := configKeys[key]; ok {
+			name = short
+		}
+		if name == "config" || fs.Lookup(name) == nil {
+			Logg(fmt.Sprintf("%s:%v: %s is not used by %s", path, lineNum, key, fs.Name()), "Debug")
+			continue
+		}
+		err = fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s:%v: %s", path, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
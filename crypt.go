@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+/*
+Encryption at rest: with -encrypt, identities.local (the email without its domain) and
+passwords.password are encrypted before they are written, so the database can be carried
+around (on the HASH DB disk...) without giving the creds away. It is envelope encryption:
+
+  - the rows are encrypted with a random data key, AES-256-GCM, a new nonce per value,
+    stored as base64(nonce + ciphertext). The column name and the hashID of the row are
+    the additional data, so a value moved to another column or row does not decrypt
+  - the data key is stored in the metadata table, encrypted (AES-256-GCM again) with a
+    key derived with scrypt from the database key and a random salt
+
+The database key is a passphrase read from the -dbkey file, the TR4IL_DB_KEY environment
+variable, or asked on the terminal. Changing it (db rekey) only encrypts the data key
+again, the rows are not touched. The domains (domains table) are not encrypted: they are
+what the search filters on.
+
+The hashIDs are computed before the encryption, the dedupe does not change.
+*/
+
+const (
+	cryptAlgorithm = "aes-256-gcm"
+	cryptKeySize   = 32
+	cryptSaltSize  = 16
+)
+
+// scrypt parameters of the key encrypting the data key
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// errDBKey is returned when the database key does not open the data key
+var errDBKey = errors.New("wrong database key")
+
+/*
+dbCrypt encrypts and decrypts the values of the encrypted columns. A nil *dbCrypt is a
+database without encryption, its methods give the values back as they are. It is safe
+for concurrent use.
+*/
+type dbCrypt struct {
+	aead cipher.AEAD
+}
+
+// credCrypt is the dbCrypt of the database being ingested, set by runIngest
+var credCrypt *dbCrypt
+
+func newDBCrypt(key []byte) (*dbCrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &dbCrypt{aead: aead}, nil
+}
+
+func (c *dbCrypt) seal(plain, ad []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		panic(err) // the system has no randomness left, nothing can be done
+	}
+	return c.aead.Seal(nonce, nonce, plain, ad)
+}
+
+func (c *dbCrypt) open(sealed, ad []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	return c.aead.Open(nil, sealed[:n], sealed[n:], ad)
+}
+
+// cellAD is the additional data of the value of column in the cred with hashID
+func cellAD(column, hashID string) []byte {
+	return []byte(column + "\x00" + hashID)
+}
+
+// Encrypt returns the value to store in column of the cred with hashID, empty values are kept empty
+func (c *dbCrypt) Encrypt(value, column, hashID string) string {
+	if c == nil || value == "" {
+		return value
+	}
+	return base64.StdEncoding.EncodeToString(c.seal([]byte(value), cellAD(column, hashID)))
+}
+
+// Decrypt returns the value stored in column of the cred with hashID in clear
+func (c *dbCrypt) Decrypt(value, column, hashID string) (string, error) {
+	if c == nil || value == "" {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("%s is not encrypted: %s", column, err)
+	}
+	plain, err := c.open(sealed, cellAD(column, hashID))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt %s: %s", column, err)
+	}
+	return string(plain), nil
+}
+
+// dbKey is the database key, loaded by loadDBKey or asked by dbPassphrase
+var dbKey []byte
+
+// loadDBKey reads the key from the -dbkey file or from TR4IL_DB_KEY
+func loadDBKey() error {
+	switch {
+	case *DBKeyFile != "":
+		key, err := ioutil.ReadFile(*DBKeyFile)
+		if err != nil {
+			return err
+		}
+		dbKey = []byte(strings.TrimSpace(string(key)))
+	case os.Getenv("TR4IL_DB_KEY") != "":
+		dbKey = []byte(os.Getenv("TR4IL_DB_KEY"))
+	}
+	return nil
+}
+
+// dbPassphrase returns the database key, asking it on the terminal if it was not given
+func dbPassphrase(prompt string) ([]byte, error) {
+	if len(dbKey) > 0 {
+		return dbKey, nil
+	}
+	key, err := askPassphrase(prompt)
+	if err != nil {
+		return nil, err
+	}
+	dbKey = key
+	return key, nil
+}
+
+func askPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !canAskPassphrase() {
+		return nil, fmt.Errorf("no database key given with -dbkey or TR4IL_DB_KEY, and no terminal to ask it")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	key, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty database key")
+	}
+	return key, nil
+}
+
+// newPassphrase asks a new database key twice on the terminal
+func newPassphrase() ([]byte, error) {
+	key, err := askPassphrase(fmt.Sprintf("New key of %s: ", *DBName))
+	if err != nil {
+		return nil, err
+	}
+	again, err := askPassphrase("Again: ")
+	if err != nil {
+		return nil, err
+	}
+	if string(again) != string(key) {
+		return nil, fmt.Errorf("the keys do not match")
+	}
+	return key, nil
+}
+
+// canAskPassphrase tells if there is a terminal to ask the database key on
+func canAskPassphrase() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// wrapKey encrypts the data key with the key derived from passphrase and a new salt
+func wrapKey(dataKey, passphrase []byte) (salt, wrapped []byte, err error) {
+	salt = make([]byte, cryptSaltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	kek, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, cryptKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newDBCrypt(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	return salt, c.seal(dataKey, []byte("data key")), nil
+}
+
+func unwrapKey(salt, wrapped, passphrase []byte) ([]byte, error) {
+	kek, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, cryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newDBCrypt(kek)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := c.open(wrapped, []byte("data key"))
+	if err != nil {
+		return nil, errDBKey
+	}
+	return dataKey, nil
+}
+
+// storeDataKey saves the data key encrypted with passphrase in the metadata
+func storeDataKey(db execer, dataKey, passphrase []byte) error {
+	salt, wrapped, err := wrapKey(dataKey, passphrase)
+	if err != nil {
+		return err
+	}
+	steps := [][2]string{
+		{"encryption", cryptAlgorithm},
+		{"encryption_salt", hex.EncodeToString(salt)},
+		{"encryption_key", base64.StdEncoding.EncodeToString(wrapped)},
+	}
+	for _, s := range steps {
+		err = setMetadata(db, s[0], s[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDataKey opens the data key of the metadata with passphrase
+func readDataKey(db execer, passphrase []byte) ([]byte, error) {
+	salt, err := getMetadata(db, "encryption_salt")
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := getMetadata(db, "encryption_key")
+	if err != nil {
+		return nil, err
+	}
+	rawSalt, err := hex.DecodeString(salt)
+	if err != nil {
+		return nil, err
+	}
+	rawWrapped, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(rawSalt, rawWrapped, passphrase)
+}
+
+// encrypted tells if the database has its creds encrypted
+func encrypted(db execer) (bool, error) {
+	algorithm, err := getMetadata(db, "encryption")
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	if algorithm != cryptAlgorithm {
+		return false, fmt.Errorf("unknown encryption %q", algorithm)
+	}
+	return true, nil
+}
+
+/*
+openCrypt returns the dbCrypt of the database, nil if it is not encrypted. The database
+key is asked on the terminal if it was not given.
+*/
+func openCrypt(db execer) (*dbCrypt, error) {
+	enc, err := encrypted(db)
+	if err != nil || !enc {
+		return nil, err
+	}
+	passphrase, err := dbPassphrase(fmt.Sprintf("Key of %s: ", *DBName))
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := readDataKey(db, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return newDBCrypt(dataKey)
+}
+
+/*
+setEncryption is the -encrypt of ingest. The encryption is chosen when the database gets
+its first creds, like the password policy: an encrypted database stays encrypted (with
+or without -encrypt), and a database with creds in clear cannot be encrypted.
+*/
+func setEncryption(db execer) (*dbCrypt, error) {
+	enc, err := encrypted(db)
+	if err != nil {
+		return nil, err
+	}
+	if enc {
+		return openCrypt(db)
+	}
+	if !*EncryptDB {
+		return nil, nil
+	}
+
+	has, err := hasCreds(db)
+	if err != nil {
+		return nil, err
+	}
+	if has {
+		return nil, fmt.Errorf("%s already has creds in clear, it cannot be encrypted", *DBName)
+	}
+
+	passphrase := dbKey
+	if len(passphrase) == 0 {
+		passphrase, err = newPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		dbKey = passphrase
+	}
+
+	dataKey := make([]byte, cryptKeySize)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	err = storeDataKey(db, dataKey, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	Logg(fmt.Sprintf("The creds of %s are encrypted, keep its key safe: without it they are lost", *DBName), "Warn")
+	return newDBCrypt(dataKey)
+}
+
+/*
+rekeyDB encrypts the data key of the database with a new database key. The data key and
+so the rows do not change, the old key simply stops working.
+*/
+func rekeyDB(db *sql.DB, newKey []byte) error {
+	passphrase, err := dbPassphrase(fmt.Sprintf("Current key of %s: ", *DBName))
+	if err != nil {
+		return err
+	}
+	dataKey, err := readDataKey(db, passphrase)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = storeDataKey(tx, dataKey, newKey)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
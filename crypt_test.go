@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// -encrypt without a hash key is refused, anyone could compute the hashIDs of the encrypted creds
+func TestIngestEncryptNeedsHashKey(t *testing.T) {
+	savedHash, savedDB := hashKey, dbKey
+	t.Cleanup(func() { hashKey, dbKey = savedHash, savedDB })
+	t.Setenv("TR4IL_HASH_KEY", "")
+	t.Setenv("TR4IL_DB_KEY", "test passphrase")
+
+	testConfig(t, "-u", t.TempDir(), "-encrypt")
+	*DBName = filepath.Join(t.TempDir(), "creds.db")
+	err := runIngest(nil)
+	var usage usageError
+	if !errors.As(err, &usage) || !strings.Contains(err.Error(), "hash key") {
+		t.Errorf("ingest -encrypt without a hash key returned %v, want a usage error", err)
+	}
+}
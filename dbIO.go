@@ -3,136 +3,183 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"reflect"
+	"strings"
 )
 
-func CreateTable() (err error) {
-	var statement *sql.Stmt
-	db, err := sql.Open("sqlite3", fmt.Sprintf("./%s", *DBName)) // Open the created SQLite File
-	CheckErr(err, "Fatal", "Could not open sqlite database")
-	defer db.Close() // Defer Closing the database
-
-	createhostsTableSQL := `CREATE TABLE hosts (
-		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
-		"domain" TEXT UNIQUE,
-		"smtp" TEXT,
-		"smtpPort" INTEGER,
-		"imap" TEXT,
-		"imapPort" INTEGER 		
-	  );` // SQL Statement for Create Table
-
-	Logg("Create hosts table...", "Debug")
-	statement, err = db.Prepare(createhostsTableSQL) // Prepare SQL Statement
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec() // Execute SQL Statements
+/*
+CreateTable builds the tables of the new database: it is the migrations from the first
+one, see migrate.go.
+*/
+func CreateTable(db *sql.DB) error {
+	n, err := migrateDB(db)
 	if err != nil {
 		return err
 	}
+	Logg(fmt.Sprintf("%s created, schema version %v", *DBName, n), "Info")
+	return nil
+}
 
-	Logg("hosts table created", "Debug")
-	createLeaksTableSQL := `CREATE TABLE leaks (
-		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
-		"name" TEXT NOT NULL,
-		"parent" TEXT NOT NULL,
-		"filename" TEXT NOT NULL, 
-		"hashID" TEXT UNIQUE NOT NULL,
-		"date" TEXT,
-		"website" TEXT,
-		"linenumber" INTEGER,
-		"status" INTEGER
-	  );` // SQL Statement for Create Table
-
-	Logg("Create leaks table...", "Debug")
-	statement, err = db.Prepare(createLeaksTableSQL) // Prepare SQL Statement
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec() // Execute SQL Statements
-	if err != nil {
-		return err
-	}
+/*
+dbColumns are the tables and columns GetForeignKey accepts. Table and column names cannot
+be bound parameters, so they are checked against this list before they go in a query;
+the values are always bound.
+*/
+var dbColumns = map[string][]string{
+	"leaks":      {"id", "name", "parent", "filename", "member", "hashID", "date", "website", "linenumber", "status"},
+	"domains":    {"id", "domain"},
+	"identities": {"id", "hashID"},
+	"passwords":  {"id", "hashID"},
+}
 
-	Logg("hosts table created", "Debug")
-
-	createCredTableSQL := `CREATE TABLE creds (
-		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
-		"email" TEXT NOT NULL,
-		"username" TEXT,
-		"password" TEXT,
-		"hashID" TEXT NOT NULL UNIQUE,
-		"valid" INTEGER NOT NULL DEFAULT 0,
-		"host" INTEGER, 
-		"firstSeen" TEXT,
-		"leak" INTEGER, 
-		FOREIGN KEY(host) REFERENCES hosts(id),
-		FOREIGN KEY(leak) REFERENCES leaks(id)
-	  );` // SQL Statement for Create Table
-
-	Logg("Create creds table...", "Debug")
-	statement, err = db.Prepare(createCredTableSQL) // Prepare SQL Statement
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec() // Execute SQL Statements
-	if err != nil {
-		return err
+// checkIdentifiers returns an error if the table or one of the columns is not in dbColumns
+func checkIdentifiers(table string, columns ...string) error {
+	known, ok := dbColumns[table]
+	if !ok {
+		return fmt.Errorf("unknown table %q", table)
+	}
+	for _, col := range columns {
+		found := false
+		for _, k := range known {
+			if col == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown column %q in %s", col, table)
+		}
 	}
-
-	Logg("creds table created", "Debug")
-	Logg(fmt.Sprintf("%s created", *DBName), "Info")
 	return nil
 }
 
-// We are passing db reference connection from main to our method with other parameters
-func InsertRow(db *sql.DB, tab DBTable, row interface{}) (err error) {
-	numRows := reflect.ValueOf(row).Len()
-	// log.Println(fmt.Sprintf("Inserting %s record ...", tab.name))
-	insertSQL := fmt.Sprintf("INSERT INTO %s(%s) VALUES", tab.name, tab.columns)
-	valuesSQL := fmt.Sprintf(" (%s)", tab.questions)
-	for j := 0; j < numRows-1; j++ {
-		valuesSQL = fmt.Sprintf("%s, (%s)", valuesSQL, tab.questions)
-	}
+/*
+A batchWriter inserts rows of one table with multi-row INSERTs. The rows are given as
+their values, in the order of columns, by a function of each table (insertLeaks...), so
+a field added to a row struct has to be added there too: nothing is matched by
+position behind our back. The statements are cut so they never have more than
+maxParams values, and the columns are checked against the tables of the database when
+it is opened (checkBatchWriters).
+*/
+type batchWriter struct {
+	verb    string // INSERT, INSERT OR IGNORE...
+	table   string
+	columns []string
+}
 
-	insertSQL = fmt.Sprint(insertSQL, valuesSQL)
-	statement, err := db.Prepare(insertSQL) // Prepare statement. This is good to avoid SQL injections
-	if err != nil {
-		return err
-	}
+// maxParams is the most values in a statement, SQLITE_MAX_VARIABLE_NUMBER of SQLite 3.32 and later
+const maxParams = 32766
+
+var (
+	leaksWriter = batchWriter{verb: "INSERT", table: "leaks",
+		columns: []string{"name", "parent", "filename", "member", "hashID", "date", "website", "linenumber", "status"}}
+	rejectsWriter = batchWriter{verb: "INSERT OR IGNORE", table: "rejects",
+		columns: []string{"leak", "line", "reason", "content"}}
+	bulkWriter = batchWriter{verb: "INSERT", table: "bulk_sightings",
+		columns: []string{"identity_hash", "local", "domain", "password_hash", "password", "leak", "line", "url", "firstSeen"}}
+)
+
+var batchWriters = []batchWriter{leaksWriter, rejectsWriter, bulkWriter}
 
+// statement returns the INSERT of n rows
+func (w batchWriter) statement(n int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(w.columns)), ", ") + ")"
+	rows := strings.TrimSuffix(strings.Repeat(row+", ", n), ", ")
+	return fmt.Sprintf("%s INTO %s(%s) VALUES %s", w.verb, w.table, strings.Join(w.columns, ", "), rows)
+}
+
+// write inserts n rows, row(i) returns the values of the row i
+func (w batchWriter) write(db execer, n int, row func(i int) []interface{}) error {
+	perStmt := maxParams / len(w.columns)
 	var args []interface{}
-	for j := 0; j < numRows; j++ {
-		rv := reflect.ValueOf(row).Index(j)
-		for i := 0; i < rv.NumField(); i++ {
-			args = append(args, rv.Field(i).Interface())
+	for start := 0; start < n; start += perStmt {
+		end := start + perStmt
+		if end > n {
+			end = n
+		}
+		args = args[:0]
+		for i := start; i < end; i++ {
+			values := row(i)
+			if len(values) != len(w.columns) {
+				return fmt.Errorf("%s: %v values for %v columns", w.table, len(values), len(w.columns))
+			}
+			args = append(args, values...)
+		}
+		_, err := db.Exec(w.statement(end-start), args...)
+		if err != nil {
+			return err
 		}
 	}
-	_, err = statement.Exec(args...)
+	return nil
+}
 
-	if err != nil {
-		return err
-	}
+func insertLeaks(db execer, leaks []leakRows) error {
+	return leaksWriter.write(db, len(leaks), func(i int) []interface{} {
+		l := leaks[i]
+		return []interface{}{l.Name, l.Parent, l.FileName, l.Member, l.HashID, l.Date, l.Website, l.LineNumber, l.Status}
+	})
+}
+
+func insertRejects(db execer, rejects []rejectRows) error {
+	return rejectsWriter.write(db, len(rejects), func(i int) []interface{} {
+		r := rejects[i]
+		return []interface{}{r.Leak, r.Line, r.Reason, r.Content}
+	})
+}
 
+// insertStaged stages the creds of ingest -bulk
+func insertStaged(db execer, creds []record) error {
+	return bulkWriter.write(db, len(creds), func(i int) []interface{} {
+		r := creds[i]
+		s := r.sighting
+		return []interface{}{r.identity.HashID, r.identity.Local, r.domain, r.password.HashID, r.password.Password,
+			s.Leak, s.Line, s.URL, s.FirstSeen}
+	})
+}
+
+// checkBatchWriters makes sure the tables of the database have the columns of the batchWriters
+func checkBatchWriters(db querier) error {
+	for _, w := range batchWriters {
+		rows, err := db.Query("SELECT name FROM pragma_table_info(?)", w.table)
+		if err != nil {
+			return err
+		}
+		have := map[string]bool{}
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			have[name] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, col := range w.columns {
+			if !have[col] {
+				return fmt.Errorf("table %s has no column %s", w.table, col)
+			}
+		}
+	}
 	return nil
 }
 
+// GetForeignKey returns the id of the row of tab where col is val
 func GetForeignKey(db *sql.DB, tab, col, val string) (id int, err error) {
-	// var id int
-	row, err := db.Query(fmt.Sprintf("SELECT id FROM %s WHERE %s = '%s';", tab, col, val))
+	err = checkIdentifiers(tab, col)
 	if err != nil {
 		return -1, err
 	}
-	defer row.Close()
-
-	for row.Next() { // Iterate and fetch the records from result cursor
-		row.Scan(&id)
-	}
-	if id == 0 {
+	err = db.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE %s = ?", tab, col), val).Scan(&id)
+	if err == sql.ErrNoRows {
 		return 0, fmt.Errorf("no rows where found for %v", val)
 	}
+	if err != nil {
+		return -1, err
+	}
 	return id, nil
-
 }
 
 func ChangeStatus(db *sql.DB, val, leakid int) (err error) {
@@ -153,20 +200,20 @@ func ChangeStatus(db *sql.DB, val, leakid int) (err error) {
 
 }
 
+// ReadCheckpoint returns how far the leak was committed, see processFile
+func ReadCheckpoint(db *sql.DB, id int) (c checkpoint, err error) {
+	err = db.QueryRow("SELECT byteoffset, lineoffset, parsed, duplicates, rejected FROM leaks WHERE id = ?", id).Scan(
+		&c.offset, &c.line, &c.counts.parsed, &c.counts.duplicates, &c.counts.rejected)
+	return c, err
+}
+
 func ReadStatus(db *sql.DB, id int) (status int, err error) {
-	// var id int
-	row, err := db.Query(fmt.Sprintf("SELECT status FROM leaks WHERE id=%v;", id))
+	err = db.QueryRow("SELECT status FROM leaks WHERE id = ?", id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return -1, fmt.Errorf("no rows where found for %v", id)
+	}
 	if err != nil {
 		return -1, err
 	}
-	defer row.Close()
-
-	for row.Next() { // Iterate and fetch the records from result cursor
-		row.Scan(&status)
-	}
-	if status == 0 {
-		return -1, fmt.Errorf("no rows where found for %v", id)
-	}
 	return status, nil
-
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the batch writers match the tables of a new database, and a missing column is found
+func TestCheckBatchWriters(t *testing.T) {
+	testConfig(t)
+	store := testStore(t)
+	err := checkBatchWriters(store.Meta())
+	if err != nil {
+		t.Fatalf("batch writers do not match a new database: %s", err)
+	}
+
+	_, err = store.Meta().Exec("ALTER TABLE rejects DROP COLUMN content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkBatchWriters(store.Meta())
+	if err == nil || !strings.Contains(err.Error(), "rejects has no column content") {
+		t.Errorf("checkBatchWriters returned %v, want the missing column of rejects", err)
+	}
+}
+
+// countingDB is a database that keeps the number of values of each statement
+type countingDB struct {
+	*sql.DB
+	params []int
+}
+
+func (db *countingDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	db.params = append(db.params, len(args))
+	return db.DB.Exec(query, args...)
+}
+
+// more rows than fit in a statement are cut in statements of at most maxParams values, and all written
+func TestBatchWriterChunks(t *testing.T) {
+	testConfig(t)
+	store := testStore(t)
+	db := &countingDB{DB: store.(*sqliteStore).db}
+	leakID := testLeak(t, store, "dump.txt")
+
+	perStmt := maxParams / len(rejectsWriter.columns)
+	n := 2*perStmt + 7
+	rejects := make([]rejectRows, n)
+	for i := range rejects {
+		rejects[i] = rejectRows{Leak: leakID, Line: i + 1, Reason: "bad-email", Content: fmt.Sprintf("line %d", i+1)}
+	}
+	err := insertRejects(db, rejects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{perStmt * 4, perStmt * 4, 7 * 4}
+	if fmt.Sprint(db.params) != fmt.Sprint(want) {
+		t.Errorf("statements of %v values, want %v", db.params, want)
+	}
+	for _, p := range db.params {
+		if p > maxParams {
+			t.Errorf("a statement has %v values, over the %v of SQLite", p, maxParams)
+		}
+	}
+	if c := testCount(t, store, "rejects"); c != n {
+		t.Errorf("%v rejects written, want %v", c, n)
+	}
+
+	// a number of columns that does not divide maxParams
+	db.params = nil
+	perStmt = maxParams / len(leaksWriter.columns)
+	leaks := make([]leakRows, perStmt+1)
+	for i := range leaks {
+		name := fmt.Sprintf("leak%d", i)
+		leaks[i] = leakRows{Name: name, Parent: "chunks", FileName: name, HashID: leakHashID("chunks", name, name, ""), Status: 1}
+	}
+	err = insertLeaks(db, leaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []int{perStmt * 9, 9}
+	if fmt.Sprint(db.params) != fmt.Sprint(want) {
+		t.Errorf("statements of %v values, want %v", db.params, want)
+	}
+	if c := testCount(t, store, "leaks"); c != len(leaks)+1 {
+		t.Errorf("%v leaks, want %v", c, len(leaks)+1)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+discoverLeaks walks the leak tree under root and returns one dirStruct per file
+that should be ingested. The tree can be nested to any depth, files are kept or
+dropped with the include/exclude glob patterns (-i / -x), -depth limits how deep
+we go and -L decides if symlinks are followed. The result is sorted so the job
+list is the same from one run to the other.
+*/
+func discoverLeaks(root string) ([]dirStruct, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	d := discovery{
+		root:     root,
+		include:  splitPatterns(*Include),
+		exclude:  splitPatterns(*Exclude),
+		maxDepth: *MaxDepth,
+		follow:   *FollowSymlinks,
+		visited:  map[string]bool{},
+	}
+
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		d.visited[real] = true
+	}
+
+	err = d.walk(root, "", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(d.jobs, func(i, j int) bool {
+		if d.jobs[i].name != d.jobs[j].name {
+			return d.jobs[i].name < d.jobs[j].name
+		}
+		return d.jobs[i].file < d.jobs[j].file
+	})
+
+	return d.jobs, nil
+}
+
+type discovery struct {
+	root     string
+	include  []string
+	exclude  []string
+	maxDepth int             // 0 means no limit
+	follow   bool            // follow symlinks to files and directories
+	visited  map[string]bool // real path of the directories already walked, stops symlink loops
+	jobs     []dirStruct
+}
+
+// walk reads dir (rel is its path relative to the root, "" for the root itself)
+// and recurses in the sub directories. depth is the depth of the entries in dir.
+func (d *discovery) walk(dir, rel string, depth int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if rel == "" {
+			return err
+		}
+		CheckErr(err, "Error", fmt.Sprint("Could not open directory:", dir))
+		return nil
+	}
+
+	for _, e := range entries {
+		entryPath := filepath.Join(dir, e.Name())
+		entryRel := filepath.ToSlash(filepath.Join(rel, e.Name()))
+
+		if matchAny(d.exclude, e.Name(), entryRel) {
+			Logg(fmt.Sprint("Excluding ", entryRel), "Debug")
+			continue
+		}
+
+		mode := e.Mode()
+		if mode&os.ModeSymlink != 0 {
+			if !d.follow {
+				Logg(fmt.Sprint("Skipping symlink ", entryRel), "Debug")
+				continue
+			}
+			target, err := os.Stat(entryPath)
+			if err != nil {
+				CheckErr(err, "Warn", fmt.Sprint("Could not follow symlink:", entryPath))
+				continue
+			}
+			mode = target.Mode()
+		}
+
+		switch {
+		case mode.IsDir():
+			if d.maxDepth > 0 && depth >= d.maxDepth {
+				continue
+			}
+			real, err := filepath.EvalSymlinks(entryPath)
+			if err != nil {
+				CheckErr(err, "Warn", fmt.Sprint("Could not resolve directory:", entryPath))
+				continue
+			}
+			if d.visited[real] {
+				Logg(fmt.Sprint("Already walked ", real, ", skipping ", entryRel), "Debug")
+				continue
+			}
+			d.visited[real] = true
+
+			err = d.walk(entryPath, entryRel, depth+1)
+			if err != nil {
+				return err
+			}
+
+		case mode.IsRegular():
+			if len(d.include) > 0 && !matchAny(d.include, e.Name(), entryRel) {
+				continue
+			}
+			name := rel
+			if name == "" {
+				name = "."
+			}
+			d.jobs = append(d.jobs, dirStruct{
+				parent: *Parent,
+				name:   name,
+				path:   dir,
+				file:   e.Name(),
+				lines:  -1,
+			})
+		}
+	}
+
+	return nil
+}
+
+// leakHashVersion is the way leakHashID is made, the leaks of a database made another way are rehashed by rehashLeaks
+const leakHashVersion = "2"
+
+// leakHashID is the id of a leak file (or archive member) in the leaks table. A fresh
+// hasher is used for every file so the same file always gets the same id. The fields are
+// separated by a NUL byte, so ("ab", "c") and ("a", "bc") are two leaks.
+func leakHashID(parent, name, file, member string) string {
+	h := sha1.New()
+	h.Write([]byte(strings.Join([]string{parent, name, file, member}, "\x00")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+rehashLeaks gives the leaks of a database made before leakHashVersion the hashID of
+leakHashID, or the next ingest would take all of them for new leaks and read them again.
+It is done once, the version is then kept in the metadata. Every UPDATE gives a leak the
+hashID of its own columns, so a rehash that was stopped is done again from the start.
+*/
+func rehashLeaks(db querier) error {
+	version, err := getMetadata(db, "leak_hash_version")
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if version == leakHashVersion {
+		return nil
+	}
+
+	type leak struct {
+		id                         int
+		parent, name, file, member string
+	}
+	rows, err := db.Query("SELECT id, coalesce(parent, ''), coalesce(name, ''), coalesce(filename, ''), coalesce(member, '') FROM leaks")
+	if err != nil {
+		return err
+	}
+	var leaks []leak
+	for rows.Next() {
+		var l leak
+		err = rows.Scan(&l.id, &l.parent, &l.name, &l.file, &l.member)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		leaks = append(leaks, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range leaks {
+		_, err = db.Exec("UPDATE leaks SET hashID = ? WHERE id = ?", leakHashID(l.parent, l.name, l.file, l.member), l.id)
+		if err != nil {
+			return fmt.Errorf("leak %v: %s", l.id, err)
+		}
+	}
+	if len(leaks) > 0 {
+		Logg(fmt.Sprintf("The hashIDs of the %v leaks of %s were made again", len(leaks), *DBName), "Info")
+	}
+	return setMetadata(db, "leak_hash_version", leakHashVersion)
+}
+
+// splitPatterns turns the comma separated list given on the command line into a slice
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchAny checks the patterns against the base name of the entry, or against its
+// path relative to the root when the pattern contains a "/".
+func matchAny(patterns []string, base, rel string) bool {
+	for _, p := range patterns {
+		target := base
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := filepath.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// fields that only differ by where one ends and the next starts are different leaks
+func TestLeakHashID(t *testing.T) {
+	for _, c := range [][2][4]string{
+		{{"ab", "c", "f", ""}, {"a", "bc", "f", ""}},
+		{{"p", "n", "dump.zip", "a.txt"}, {"p", "n", "dump.zipa", ".txt"}},
+		{{"p", "n", "f", ""}, {"p", "nf", "", ""}},
+	} {
+		a, b := c[0], c[1]
+		if leakHashID(a[0], a[1], a[2], a[3]) == leakHashID(b[0], b[1], b[2], b[3]) {
+			t.Errorf("%q and %q have the same hashID", a, b)
+		}
+	}
+	if leakHashID("p", "n", "f", "m") != leakHashID("p", "n", "f", "m") {
+		t.Error("the same leak has two hashIDs")
+	}
+}
+
+// the leaks of a database made with the hashID without separators are found again after rehashLeaks
+func TestRehashLeaks(t *testing.T) {
+	testConfig(t)
+	store := testStore(t)
+	db := store.Meta()
+
+	h := sha1.New()
+	h.Write([]byte(fmt.Sprint("leaks", "dump", "dump.zip", "a.txt")))
+	old := hex.EncodeToString(h.Sum(nil))
+	id, err := store.AddLeak(leakRows{Name: "dump", Parent: "leaks", FileName: "dump.zip", Member: "a.txt", HashID: old, Status: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setMetadata(db, "leak_hash_version", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = rehashLeaks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.LeakID(leakHashID("leaks", "dump", "dump.zip", "a.txt"))
+	if err != nil || got != id {
+		t.Errorf("leak %v not found by its new hashID: %v, %v", id, got, err)
+	}
+	version, err := getMetadata(db, "leak_hash_version")
+	if err != nil || version != leakHashVersion {
+		t.Errorf("leak_hash_version %q (%v), want %q", version, err, leakHashVersion)
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/*
+The hashIDs are what the dedupe works on. An identity (an email, or a login that is not
+one) and a password each have their own, computed from a canonical form so that the same
+email or password gives the same hashID in every run and every file. A cred is an
+identity with a password, it is the same cred when both hashIDs are the same. The
+canonical form is versioned: the version is the prefix of the hashIDs, and is stored in
+the metadata table so a database built with another version (or another key) is caught
+before mixing hashIDs.
+
+	v2: identity  "email" + "\x00" + lower(trim(email))
+	    password  "password" + "\x00" + trim(password)
+	    hashID = "v2:" + hex(HMAC-SHA256(key, canonical form))
+
+The password is hashed as it was in the leak, before the storage policy (see
+passwordPolicies): with the mask policy "hunter2" and "harbor2" are both stored as
+"h*****2" but stay two passwords. Only a database of plaintext passwords can have its
+password hashIDs recomputed (rehashCreds), the others keep theirs. v1 hashed the email and the password
+together, for the creds table of before the normalised schema (see convertCreds).
+
+The key comes from -hashkey (a file) or the TR4IL_HASH_KEY environment variable. Without
+a key the hashIDs can be computed by anyone holding a list of emails or passwords.
+*/
+
+const hashVersion = "v2"
+
+// errHashKey is returned by checkHashVersion when the key is not the one of the database
+var errHashKey = errors.New("the hash key is not the one the database was built with")
+
+// hashKey is the HMAC key of the hashIDs, loaded once by loadHashKey
+var hashKey []byte
+
+// loadHashKey reads the key from the -hashkey file or from TR4IL_HASH_KEY
+func loadHashKey() error {
+	switch {
+	case *HashKeyFile != "":
+		key, err := ioutil.ReadFile(*HashKeyFile)
+		if err != nil {
+			return err
+		}
+		hashKey = []byte(strings.TrimSpace(string(key)))
+	case os.Getenv("TR4IL_HASH_KEY") != "":
+		hashKey = []byte(os.Getenv("TR4IL_HASH_KEY"))
+	default:
+		Logg("No hash key given (-hashkey or TR4IL_HASH_KEY), the hashIDs are not keyed", "Warn")
+		hashKey = nil
+	}
+	return nil
+}
+
+// credHasher computes hashIDs, it is not safe for concurrent use so every worker has its own
+type credHasher struct {
+	h hash.Hash
+}
+
+func newCredHasher() *credHasher {
+	return &credHasher{h: hmac.New(sha256.New, hashKey)}
+}
+
+func (c *credHasher) hashID(kind, canonical string) string {
+	c.h.Reset()
+	c.h.Write([]byte(kind + "\x00" + canonical))
+	return hashVersion + ":" + hex.EncodeToString(c.h.Sum(nil))
+}
+
+// IdentityID is the hashID of the identity of an email (or login)
+func (c *credHasher) IdentityID(email string) string {
+	return c.hashID("email", strings.ToLower(strings.TrimSpace(email)))
+}
+
+// PasswordID is the hashID of a password, as it was in the leak and not as it is stored
+func (c *credHasher) PasswordID(password string) string {
+	return c.hashID("password", strings.TrimSpace(password))
+}
+
+// joinIdentity is the email of an identity, a login that is not an email has no domain
+func joinIdentity(local, domain string) string {
+	if domain == "" {
+		return local
+	}
+	return local + "@" + domain
+}
+
+// hashKeyCheck is stored in the metadata table to find out if the key changed, it does not give the key away
+func hashKeyCheck() string {
+	h := hmac.New(sha256.New, hashKey)
+	h.Write([]byte("tr4ilgo hash key check"))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// execer is what *sql.DB and *sql.Tx have in common
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getMetadata(db execer, key string) (value string, err error) {
+	err = db.QueryRow("SELECT value FROM metadata WHERE key = ?", key).Scan(&value)
+	return value, err
+}
+
+func setMetadata(db execer, key, value string) error {
+	_, err := db.Exec("INSERT INTO metadata(key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+// hasCreds tells if the database has any identity or password yet
+func hasCreds(db execer) (bool, error) {
+	var has bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM identities) OR EXISTS (SELECT 1 FROM passwords)").Scan(&has)
+	return has, err
+}
+
+/*
+checkHashVersion makes sure the hashIDs in the database were made with the current
+version and key. A new (or empty) database is stamped with them. A database with creds
+and another version, or none, needs a db migrate.
+*/
+func checkHashVersion(db execer) error {
+	version, err := getMetadata(db, "hash_version")
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if version != hashVersion {
+		has, err := hasCreds(db)
+		if err != nil {
+			return err
+		}
+		switch {
+		case has && version == "":
+			return fmt.Errorf("the hashIDs of %s were made by an older version, run 'tr4ilgo db migrate' to update them", *DBName)
+		case has:
+			return fmt.Errorf("the hashIDs of %s are %s, this version needs %s, run 'tr4ilgo db migrate' to update them", *DBName, version, hashVersion)
+		}
+		err = setMetadata(db, "hash_version", hashVersion)
+		if err == nil {
+			err = setMetadata(db, "hash_key_check", hashKeyCheck())
+		}
+		return err
+	}
+
+	check, _ := getMetadata(db, "hash_key_check")
+	if check != hashKeyCheck() {
+		return errHashKey
+	}
+	return nil
+}
+
+// rehashChunk is the number of rows read at a time by rehashCreds and convertCreds
+const rehashChunk = 10000
+
+/*
+rehashCreds recomputes the hashID of every identity and password with the current
+canonical form and key, and merges the ones that turn out to be the same: the oldest row
+(lowest id) is kept, the sightings of the others are moved to it and they are deleted.
+It all happens in one transaction, so either the whole database is updated or nothing is.
+
+The password hashIDs are computed from the passwords of the leaks, they can only be
+recomputed when the passwords are stored in clear. With another policy the passwords keep
+their hashIDs: the same password ingested again gets a row of its own.
+*/
+func rehashCreds(db *sql.DB) (merged int, err error) {
+	crypt, err := openCrypt(db)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	policy, err := storedPasswordPolicy(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	hasher := newCredHasher()
+	tables := []rehashTable{
+		{table: "identities", column: "local", ref: "identity", other: "password",
+			query: `SELECT i.id, i.hashID, i.local, coalesce(d.domain, '') FROM identities i
+				LEFT JOIN domains d ON d.id = i.domain_id WHERE i.id > ? ORDER BY i.id LIMIT ?`,
+			hash: func(local, domain string) string { return hasher.IdentityID(joinIdentity(local, domain)) }},
+	}
+	if policy == passwordPlaintext {
+		tables = append(tables, rehashTable{table: "passwords", column: "password", ref: "password", other: "identity",
+			query: "SELECT id, hashID, coalesce(password, ''), '' FROM passwords WHERE id > ? ORDER BY id LIMIT ?",
+			hash:  func(password, _ string) string { return hasher.PasswordID(password) }})
+	} else {
+		Logg(fmt.Sprintf("The passwords are stored as %s, their hashIDs cannot be recomputed and are kept", policy), "Warn")
+	}
+	for _, t := range tables {
+		n, err := t.rehash(tx, crypt)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", t.table, err)
+		}
+		merged += n
+	}
+
+	err = setMetadata(tx, "hash_version", hashVersion)
+	if err != nil {
+		return 0, err
+	}
+	err = setMetadata(tx, "hash_key_check", hashKeyCheck())
+	if err != nil {
+		return 0, err
+	}
+
+	return merged, tx.Commit()
+}
+
+// rehashTable is how rehashCreds goes over identities or passwords
+type rehashTable struct {
+	table  string // table rehashed
+	column string // its encrypted column
+	ref    string // column of sightings pointing to it
+	other  string // the other reference of sightings
+	query  string // id, hashID, column and domain of the rows after an id
+	hash   func(value, domain string) string
+}
+
+func (t rehashTable) rehash(tx *sql.Tx, crypt *dbCrypt) (merged int, err error) {
+	// the encrypted values are bound to the hashID, they are encrypted again with the new one
+	_, err = tx.Exec("CREATE TEMP TABLE rehash (id INTEGER PRIMARY KEY, hash TEXT NOT NULL, value TEXT)")
+	if err != nil {
+		return 0, err
+	}
+	insert, err := tx.Prepare("INSERT INTO rehash(id, hash, value) VALUES (?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+
+	lastID := 0
+	for {
+		type row struct {
+			id                    int
+			hashID, value, domain string
+		}
+		chunk := []row{}
+		rows, err := tx.Query(t.query, lastID, rehashChunk)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var r row
+			err = rows.Scan(&r.id, &r.hashID, &r.value, &r.domain)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+			chunk = append(chunk, r)
+		}
+		rows.Close()
+		if len(chunk) == 0 {
+			break
+		}
+
+		for _, r := range chunk {
+			clear, err := crypt.Decrypt(r.value, t.column, r.hashID)
+			if err != nil {
+				return 0, fmt.Errorf("row %v: %s", r.id, err)
+			}
+			hash := t.hash(clear, r.domain)
+			_, err = insert.Exec(r.id, hash, crypt.Encrypt(clear, t.column, hash))
+			if err != nil {
+				return 0, err
+			}
+		}
+		lastID = chunk[len(chunk)-1].id
+		Logg(fmt.Sprintf("Rehashed %s up to id %v", t.table, lastID), "Info")
+	}
+
+	steps := []string{
+		"CREATE INDEX temp.rehash_hash ON rehash(hash)",
+		"CREATE TEMP TABLE keepers AS SELECT hash, min(id) AS keep FROM rehash GROUP BY hash",
+		"CREATE UNIQUE INDEX temp.keepers_hash ON keepers(hash)",
+		"CREATE TEMP TABLE merged AS SELECT id FROM rehash WHERE id NOT IN (SELECT keep FROM keepers)",
+		// the sightings of the duplicates go to the row that is kept
+		fmt.Sprintf(`INSERT OR IGNORE INTO sightings(%[1]s, %[2]s, leak, line, url, firstSeen)
+			SELECT k.keep, s.%[2]s, s.leak, s.line, s.url, s.firstSeen FROM sightings s
+			JOIN rehash r ON r.id = s.%[1]s
+			JOIN keepers k ON k.hash = r.hash
+			WHERE s.%[1]s != k.keep`, t.ref, t.other),
+		fmt.Sprintf("DELETE FROM sightings WHERE %s IN (SELECT id FROM merged)", t.ref),
+	}
+	for _, step := range steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM merged)", t.table))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	merged = int(n)
+
+	steps = []string{
+		fmt.Sprintf("UPDATE %[1]s SET (hashID, %[2]s) = (SELECT hash, value FROM rehash WHERE rehash.id = %[1]s.id)", t.table, t.column),
+		"DROP TABLE temp.merged",
+		"DROP TABLE temp.keepers",
+		"DROP TABLE temp.rehash",
+	}
+	for _, step := range steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return merged, nil
+}
+
+// legacyTables are the tables of before the normalised schema, renamed by migration 8
+var legacyTables = []string{"creds_leaks_v1", "creds_v1", "hosts_v1"}
+
+/*
+legacyCreds tells if the database still has creds in the tables of before the normalised
+schema, they have to be moved with db migrate (convertCreds). Old tables that are empty
+are simply dropped.
+*/
+func legacyCreds(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'creds_v1'").Scan(&n)
+	if err != nil || n == 0 {
+		return false, err
+	}
+	var has bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM creds_v1)").Scan(&has)
+	if err != nil || has {
+		return has, err
+	}
+	return false, dropLegacy(db)
+}
+
+/*
+legacySightings gives the converted creds that still have no sighting one in the leak
+"legacy": the old versions wrote 0 in creds.leak and did not always fill creds_leaks, so
+for those creds the leak they came from is not known. The leak is only added if needed.
+*/
+func legacySightings(tx *sql.Tx) error {
+	var orphans int
+	err := tx.QueryRow(`SELECT count(*) FROM converted m
+		WHERE NOT EXISTS (SELECT 1 FROM sightings s WHERE s.identity = m.identity AND s.password = m.password)`).Scan(&orphans)
+	if err != nil || orphans == 0 {
+		return err
+	}
+
+	hashID := leakHashID("legacy", "legacy", "creds_v1", "")
+	_, err = tx.Exec(`INSERT OR IGNORE INTO leaks(name, parent, filename, member, hashID, linenumber, status)
+		VALUES ('legacy', 'legacy', 'creds_v1', '', ?, 0, 3)`, hashID)
+	if err != nil {
+		return err
+	}
+	var leakID int
+	err = tx.QueryRow("SELECT id FROM leaks WHERE hashID = ?", hashID).Scan(&leakID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR IGNORE INTO sightings(identity, password, leak, url, firstSeen)
+		SELECT m.identity, m.password, ?, c.url, c.firstSeen FROM converted m
+		JOIN creds_v1 c ON c.id = m.cred
+		WHERE NOT EXISTS (SELECT 1 FROM sightings s WHERE s.identity = m.identity AND s.password = m.password)
+		ORDER BY m.cred`, leakID)
+	if err != nil {
+		return err
+	}
+	Logg(fmt.Sprintf("%v creds had no known leak, they are in the leak \"legacy\" (id %v)", orphans, leakID), "Warn")
+	return nil
+}
+
+func dropLegacy(db execer) error {
+	for _, table := range legacyTables {
+		_, err := db.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+convertCreds moves the creds of the tables of before the normalised schema to identities,
+passwords and sightings, and drops the old tables. The hashIDs are computed again, so it
+needs the hash key, and the key of an encrypted database. The old username column is
+not kept: it was the local part of the email. It all happens in one transaction.
+*/
+func convertCreds(db *sql.DB) (converted int, err error) {
+	crypt, err := openCrypt(db)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("CREATE TEMP TABLE converted (cred INTEGER PRIMARY KEY, identity INTEGER NOT NULL, password INTEGER NOT NULL)")
+	if err != nil {
+		return 0, err
+	}
+	stmts := map[string]*sql.Stmt{}
+	for name, query := range map[string]string{
+		"insertIdentity":  sqliteWriteSQL["insertIdentity"],
+		"selectIdentity":  sqliteWriteSQL["selectIdentity"],
+		"insertPassword":  sqliteWriteSQL["insertPassword"],
+		"selectPassword":  sqliteWriteSQL["selectPassword"],
+		"insertConverted": "INSERT INTO converted(cred, identity, password) VALUES (?, ?, ?)",
+	} {
+		stmts[name], err = tx.Prepare(query)
+		if err != nil {
+			return 0, err
+		}
+		defer stmts[name].Close()
+	}
+
+	hasher := newCredHasher()
+	lastID := 0
+	for {
+		type cred struct {
+			id                              int
+			email, password, hashID, domain string
+			host                            sql.NullInt64
+		}
+		chunk := []cred{}
+		// the domains were lowercased and merged by the migrations, host is the id of the lowercase one
+		rows, err := tx.Query(`SELECT c.id, c.email, coalesce(c.password, ''), c.hashID,
+			(SELECT d.id FROM domains d WHERE d.domain = lower(h.domain)), coalesce(h.domain, '')
+			FROM creds_v1 c LEFT JOIN hosts_v1 h ON h.id = c.host
+			WHERE c.id > ? ORDER BY c.id LIMIT ?`, lastID, rehashChunk)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var c cred
+			err = rows.Scan(&c.id, &c.email, &c.password, &c.hashID, &c.host, &c.domain)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+			chunk = append(chunk, c)
+		}
+		rows.Close()
+		if len(chunk) == 0 {
+			break
+		}
+
+		for _, c := range chunk {
+			email, err := crypt.Decrypt(c.email, "email", c.hashID)
+			if err != nil {
+				return 0, fmt.Errorf("cred %v: %s", c.id, err)
+			}
+			password, err := crypt.Decrypt(c.password, "password", c.hashID)
+			if err != nil {
+				return 0, fmt.Errorf("cred %v: %s", c.id, err)
+			}
+
+			local, domainID := email, interface{}(nil)
+			if c.domain != "" && strings.HasSuffix(strings.ToLower(email), "@"+strings.ToLower(c.domain)) {
+				local, domainID = email[:len(email)-len(c.domain)-1], c.host.Int64
+			}
+			iHash, pHash := hasher.IdentityID(email), hasher.PasswordID(password)
+			identity, _, err := insertID(stmts["insertIdentity"], stmts["selectIdentity"], iHash, crypt.Encrypt(local, "local", iHash), domainID)
+			if err != nil {
+				return 0, err
+			}
+			passwordID, _, err := insertID(stmts["insertPassword"], stmts["selectPassword"], pHash, crypt.Encrypt(password, "password", pHash))
+			if err != nil {
+				return 0, err
+			}
+			_, err = stmts["insertConverted"].Exec(c.id, identity, passwordID)
+			if err != nil {
+				return 0, err
+			}
+			converted++
+		}
+		lastID = chunk[len(chunk)-1].id
+		Logg(fmt.Sprintf("Converted creds up to id %v", lastID), "Info")
+	}
+
+	steps := []string{
+		// the leak the cred was first seen in gets the first sighting
+		`INSERT OR IGNORE INTO sightings(identity, password, leak, line, url, firstSeen)
+			SELECT m.identity, m.password, cl.leak, cl.line, c.url, c.firstSeen FROM creds_leaks_v1 cl
+			JOIN converted m ON m.cred = cl.cred
+			JOIN creds_v1 c ON c.id = cl.cred
+			JOIN leaks l ON l.id = cl.leak
+			ORDER BY cl.cred, cl.leak != c.leak, cl.leak`,
+		// creds_leaks_v1 only has the creds of the leaks that were set on them, try creds_v1.leak
+		`INSERT OR IGNORE INTO sightings(identity, password, leak, url, firstSeen)
+			SELECT m.identity, m.password, c.leak, c.url, c.firstSeen FROM converted m
+			JOIN creds_v1 c ON c.id = m.cred
+			JOIN leaks l ON l.id = c.leak
+			WHERE NOT EXISTS (SELECT 1 FROM sightings s WHERE s.identity = m.identity AND s.password = m.password)
+			ORDER BY m.cred`,
+	}
+	for _, step := range steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = legacySightings(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// nothing is dropped unless every cred of creds_v1 has a sighting
+	var total, missing int
+	err = tx.QueryRow("SELECT count(*) FROM creds_v1").Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow(`SELECT count(*) FROM converted m
+		WHERE NOT EXISTS (SELECT 1 FROM sightings s WHERE s.identity = m.identity AND s.password = m.password)`).Scan(&missing)
+	if err != nil {
+		return 0, err
+	}
+	if converted != total || missing > 0 {
+		return 0, fmt.Errorf("%v creds of %v converted, %v without a sighting: the old tables are kept", converted-missing, total, missing)
+	}
+	_, err = tx.Exec("DROP TABLE temp.converted")
+	if err != nil {
+		return 0, err
+	}
+	err = dropLegacy(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	err = setMetadata(tx, "hash_version", hashVersion)
+	if err != nil {
+		return 0, err
+	}
+	err = setMetadata(tx, "hash_key_check", hashKeyCheck())
+	if err != nil {
+		return 0, err
+	}
+	return converted, tx.Commit()
+}
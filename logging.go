@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+/*
+The logs go to stderr through logrus, with the fields of what they are about rather than
+in the text: run_id on every line, and leak_id, file, worker_id and lines where they
+apply. -logformat picks how they are written:
+
+  - text: coloured when stderr is a terminal, logfmt otherwise (the default)
+  - logfmt: key=value pairs, never coloured
+  - json: one JSON object per line
+
+With -logfile they also go to that file, as logfmt (or JSON with -logformat json), and the
+file is rotated once it is -logsize MB, keeping -logkeep old ones.
+*/
+
+const (
+	logText   = "text"
+	logFmt    = "logfmt"
+	logJSON   = "json"
+	logFileMB = 100
+)
+
+// runID tells apart the lines of the runs in a log file shared by several of them
+var runID = newRunID()
+
+// logger is the entry every line is logged with, it carries run_id
+var logger = log.WithField("run_id", runID)
+
+// logFile is the -logfile, nil if not set, it is closed by run
+var logFile *lumberjack.Logger
+
+func newRunID() string {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Sprint(os.Getpid())
+	}
+	return hex.EncodeToString(b)
+}
+
+/*
+logFormatter returns the formatter of format, tty tells if it writes to a terminal. Only
+a terminal gets colours, the escapes are noise in a file or a pipe.
+*/
+func logFormatter(format string, tty bool) (log.Formatter, error) {
+	switch format {
+	case logText:
+		return &log.TextFormatter{ForceColors: tty, DisableColors: !tty, FullTimestamp: true}, nil
+	case logFmt:
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true}, nil
+	case logJSON:
+		return &log.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown -logformat %q, expecting text, logfmt or json", format)
+}
+
+// setupLogging sets the level, the format and the file of the logs from the flags
+func setupLogging() error {
+	setLogLevel()
+
+	formatter, err := logFormatter(*LogFormat, term.IsTerminal(int(os.Stderr.Fd())))
+	if err != nil {
+		return err
+	}
+	log.SetFormatter(formatter)
+	log.SetOutput(os.Stderr)
+
+	if *LogFile == "" {
+		return nil
+	}
+	if *LogMaxSize < 1 || *LogBackups < 0 {
+		return fmt.Errorf("-logsize has to be 1 or more and -logkeep 0 or more")
+	}
+	err = os.MkdirAll(filepath.Dir(*LogFile), 0700)
+	if err != nil {
+		return fmt.Errorf("could not make the directory of the log file: %s", err)
+	}
+	logFile = &lumberjack.Logger{
+		Filename:   *LogFile,
+		MaxSize:    *LogMaxSize,
+		MaxBackups: *LogBackups,
+	}
+	fileFormat := logFmt
+	if *LogFormat == logJSON {
+		fileFormat = logJSON
+	}
+	formatter, _ = logFormatter(fileFormat, false)
+	log.AddHook(fileHook{w: logFile, formatter: formatter})
+	return nil
+}
+
+// closeLogFile closes the -logfile, if there is one
+func closeLogFile() {
+	if logFile != nil {
+		logFile.Close()
+	}
+}
+
+// fileHook writes every line logged to w too, with its own formatter (no colours)
+type fileHook struct {
+	w         io.Writer
+	formatter log.Formatter
+}
+
+func (h fileHook) Levels() []log.Level { return log.AllLevels }
+
+func (h fileHook) Fire(e *log.Entry) error {
+	b, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	_, err = h.w.Write(b)
+	return err
+}
+
+// leakFields are the fields of the lines about the leak of job
+func leakFields(job dirStruct) log.Fields {
+	file := filepath.Join(job.path, job.file)
+	if job.member != "" {
+		file += "!" + job.member
+	}
+	return log.Fields{"leak_id": job.leakID, "file": file}
+}
+
+// CheckErr logs text with err at level, if err is not nil
+func CheckErr(err error, level, text string) {
+	CheckErrWith(nil, err, level, text)
+}
+
+// CheckErrWith is CheckErr with the fields of what the error is about
+func CheckErrWith(fields log.Fields, err error, level, text string) {
+	if err == nil {
+		return
+	}
+	all := log.Fields{"error": err.Error()}
+	for k, v := range fields {
+		all[k] = v
+	}
+	LoggWith(all, text, level)
+}
+
+// Logg logs text at level: Error, Warn, Info or Debug
+func Logg(text, level string) {
+	LoggWith(nil, text, level)
+}
+
+// LoggWith is Logg with the fields of what the line is about (leak_id, file, worker_id, lines...)
+func LoggWith(fields log.Fields, text, level string) {
+	entry := logger.WithFields(fields)
+	switch level {
+	case "Error":
+		entry.Error(text)
+	case "Warn":
+		entry.Warn(text)
+	case "Info":
+		entry.Info(text)
+	case "Debug":
+		entry.Debug(text)
+	default:
+		// a level that is not one of the four is a bug, the line is not lost for it
+		entry.WithField("level_name", level).Error(text)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a line with a level that is not one of the four is logged as an error, not dropped
+func TestLoggWithUnknownLevel(t *testing.T) {
+	var buf bytes.Buffer
+	formatter := log.StandardLogger().Formatter
+	log.SetOutput(&buf)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetFormatter(formatter)
+	}()
+
+	LoggWith(log.Fields{"leak_id": 7}, "the line", "Warning")
+	out := buf.String()
+	for _, want := range []string{`"level":"error"`, `"msg":"the line"`, `"level_name":"Warning"`, `"leak_id":7`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("logged %q, want %s in it", out, want)
+		}
+	}
+}
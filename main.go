@@ -1,223 +1,251 @@
 package main
 
 import (
-	"crypto/sha1"
-	"database/sql"
-	"encoding/hex"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/evilsocket/islazy/tui"
-	log "github.com/sirupsen/logrus"
 
 	_ "github.com/mattn/go-sqlite3" // Import go-sqlite3 library
 )
 
 type JobParam struct {
-	DB      *sql.DB
-	Mutex   *sync.Mutex
+	Store   Store
+	Sink    *parquetSink // the -parquet file, nil if not set
 	JobList []dirStruct
 }
 
-type DBTable struct {
-	columns   string // = "domain, smtp, smtpPort, imap, imapPort"
-	questions string //  = "?, ?, ?, ?, ?"
-	name      string // host
-}
-
-type hostRows struct {
-	Domain   string
-	Smtp     string
-	SmtpPort int
-	Imap     string
-	ImapPort int
-}
-
 type leakRows struct {
 	Name       string
 	Parent     string
 	FileName   string
+	Member     string
 	HashID     string
 	Date       string
 	Website    string
 	LineNumber int
-	Status     int // 0: never read; 1: started; 2: finished
+	Status     int // 1: new; 2: started; 3: done, see leakStatus
 }
 
-type credRows struct {
-	Email     string
-	Username  string
-	Password  string
-	HashID    string
-	Valid     int
-	Host      int
-	FirstSeen string
-	Leak      int
+type identityRows struct {
+	HashID string
+	Local  string // part of the email before the '@', the whole login if it is not an email
+	Domain int    // id in domains, 0 for none
 }
 
-var (
-	msg        string
-	LogLvl     string
-	hostsTable = DBTable{
-		columns:   "domain, smtp, smtpPort, imap, imapPort",
-		questions: "?, ?, ?, ?, ?",
-		name:      "hosts",
-	}
-
-	leaksTable = DBTable{
-		columns:   "name, parent, filename, hashID, date, website, linenumber, status",
-		questions: "?, ?, ?, ?, ?, ?, ?, ?",
-		name:      "leaks",
-	}
+type passwordRows struct {
+	HashID   string
+	Password string // as stored, see passwordPolicies
+}
 
-	credsTable = DBTable{
-		columns:   "email, username, password, hashID, valid, host, firstSeen, leak",
-		questions: "?, ?, ?, ?, ?, ?, ?, ?",
-		name:      "creds",
-	}
+type sightingRows struct {
+	Identity  int
+	Password  int
+	Leak      int
+	Line      int
+	URL       string
+	FirstSeen string
+}
 
-	DBName    = flag.String("d", "creds.db", "Name of the database.")
-	Path      = flag.String("u", "/media/parrot/HASHDB", "Path where the raw leak files are.")
-	NWorkers  = flag.Int("w", 50, "Number of workers to go scan files. Each worker will scrap one text file at a time.")
-	Parent    = flag.String("p", "Collection 1", "Name of the parent directory")
-	CleanDB   = flag.Bool("r", false, "Delets the database to start fresh. NO RETURN")
-	LogLevel  = flag.String("v", "", "Log level [default: WARN | v: INFO | vv: DEBUG ]")
-	BatchSize = flag.Int("b", 1000, "Batch size when inserting to database. When scrapping the file list, a slice is made and when it reaches a given size, a batch INSERT is made to the database.")
-)
+// LogLvl is the name of the log level, for printParam
+var LogLvl string
 
-func main() {
+/*
+runIngest reads the leaks under -u/-p into the database, this is what tr4ilGo did before
+it had subcommands.
+*/
+func runIngest(fs *flag.FlagSet) error {
 
 	if !tui.Effects() {
 		fmt.Printf("\n\nWARNING: This terminal does not support colours, view will be very limited.\n\n")
 	}
 
 	ASCIIArt()
+	printParam()
 
-	flag.Parse()
-
-	switch {
-	case *LogLevel == "":
-		log.SetLevel(log.WarnLevel)
-		LogLvl = "Warning"
-	case *LogLevel == "v":
-		log.SetLevel(log.InfoLevel)
-		LogLvl = "Info"
-	case *LogLevel == "vv":
-		log.SetLevel(log.DebugLevel)
-		log.SetReportCaller(true)
-		LogLvl = "Debug"
-		go func() {
-			log.Println(http.ListenAndServe("localhost:6060", nil))
-		}()
+	err := checkFormats()
+	if err != nil {
+		return usageError{err}
+	}
+	err = loadHashKey()
+	if err != nil {
+		return fmt.Errorf("could not read the hash key: %s", err)
+	}
+	err = checkPasswordPolicy()
+	if err != nil {
+		return usageError{err}
+	}
+	err = loadDBKey()
+	if err != nil {
+		return fmt.Errorf("could not read the database key: %s", err)
+	}
+	if *EncryptDB && len(dbKey) == 0 && !canAskPassphrase() {
+		return usageError{fmt.Errorf("-encrypt needs a key: -dbkey, TR4IL_DB_KEY or a terminal to ask it")}
+	}
+	if *EncryptDB && len(hashKey) == 0 {
+		// unkeyed hashIDs of the emails and passwords would give away what the encryption hides
+		return usageError{fmt.Errorf("-encrypt needs a hash key (-hashkey or TR4IL_HASH_KEY)")}
+	}
+	if *NWorkers < 1 {
+		// no worker would take the leaks, sendWork would wait for one forever
+		return usageError{fmt.Errorf("-w has to be 1 or more")}
+	}
+	if *BulkLoad && isPostgres(*DBName) {
+		return usageError{fmt.Errorf("-bulk is for SQLite, PostgreSQL always loads with COPY")}
+	}
+	if *BulkLoad && *BulkTx < 1 {
+		return usageError{fmt.Errorf("-bulktx has to be 1 or more")}
+	}
+	if *CleanDB && isPostgres(*DBName) {
+		return usageError{fmt.Errorf("-r only deletes SQLite files, drop the PostgreSQL tables by hand")}
 	}
-
-	printParam()
 	if *CleanDB {
-		os.Remove(*DBName)
+		err = removeDB(*DBName)
+		if err != nil {
+			return err
+		}
 		Logg(fmt.Sprintf("Database '%s' was successfully deleted", *DBName), "Warn")
 	}
 
-	if _, err := os.Stat(*DBName); os.IsNotExist(err) {
-		Logg(fmt.Sprintf("Database does not exist - creating %s...", *DBName), "Warn")
-
-		file, err := os.Create(*DBName) // Create SQLite file
-		CheckErr(err, "Fatal", "Could not create database file")
-		file.Close()
-
-		err = CreateTable()
-		CheckErr(err, "Fatal", "Could not create tables")
+	store, err := openStore(true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	db := store.Meta()
 
+	err = checkHashVersion(db)
+	if err == nil {
+		err = rehashLeaks(db)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot ingest in this database: %s", err)
+	}
+	err = setPasswordPolicy(db)
+	if err != nil {
+		return fmt.Errorf("cannot ingest in this database: %s", err)
+	}
+	credCrypt, err = setEncryption(db)
+	if err != nil {
+		return fmt.Errorf("cannot ingest in this database: %s", err)
 	}
 
-	db, _ := sql.Open("sqlite3", fmt.Sprintf("./%s", *DBName))
-	defer db.Close()
+	// the creds of a bulk load that was stopped go in first
+	err = store.FinishLoad()
+	if err != nil {
+		return fmt.Errorf("could not merge the bulk load: %s", err)
+	}
 
 	param := JobParam{
-		DB:    db,
-		Mutex: &sync.Mutex{}}
+		Store: store}
+	if *Parquet != "" {
+		param.Sink, err = newParquetSink(*Parquet)
+		if err != nil {
+			return fmt.Errorf("could not create the Parquet file: %s", err)
+		}
+	}
 
-	scanWorkingDir(param)
+	if *Metrics != "" {
+		serveMetrics(*Metrics)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	interrupted, err := scanWorkingDir(ctx, param)
+	if param.Sink != nil {
+		closeErr := param.Sink.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
 
+	if interrupted {
+		// the staged creds of -bulk are merged by the next ingest
+		return errInterrupted
+	}
+	err = store.FinishLoad()
+	if err != nil {
+		return fmt.Errorf("could not merge the bulk load: %s", err)
+	}
+	if *BulkLoad {
+		// back to a database in a single file
+		_, err = db.Exec("PRAGMA journal_mode = DELETE")
+		CheckErr(err, "Warn", "Could not set the journal mode back")
+	}
+	return nil
 }
 
-func scanWorkingDir(param JobParam) {
-	h := sha1.New()
+// scanWorkingDir finds the leaks to read and reads them, interrupted tells if ctx was cancelled before the end
+func scanWorkingDir(ctx context.Context, param JobParam) (interrupted bool, err error) {
 	var id int
 	var lineNum int
 	var status int
-	var dirS dirStruct
 
 	Logg("Indexing raw files...", "Debug")
 
 	sliceDir := []dirStruct{}
 
 	wd := filepath.Join(*Path, *Parent)
-	dirs, err := ioutil.ReadDir(wd)
+	found, err := discoverLeaks(wd)
+	if err != nil {
+		return false, fmt.Errorf("could not open directory %s: %s", wd, err)
+	}
+	Logg(fmt.Sprintf("Found %v files in %s", len(found), wd), "Info")
+	found = expandArchives(found, param.Store)
 
-	CheckErr(err, "Fatal", fmt.Sprint("Could not open directory:", wd))
+	for _, dirS := range found {
+		if ctx.Err() != nil {
+			return true, nil
+		}
+		hash := leakHashID(dirS.parent, dirS.name, dirS.file, dirS.member)
 
-	for _, d := range dirs {
-		if !(strings.Contains(d.Name(), ".tar")) {
+		id, err = param.Store.LeakID(hash)
 
-			dirS = dirStruct{parent: *Parent,
-				name: d.Name(),
-				path: filepath.Join(wd, d.Name()),
+		if err != nil {
+			LoggWith(leakFields(dirS), "Adding file to db", "Debug")
+			lineNum = dirS.lines
+			if lineNum < 0 {
+				lineNum, err = countLeakLines(dirS)
+				CheckErrWith(leakFields(dirS), err, "Warn", "Trying to count number of lines in file")
 			}
 
-			files, err := ioutil.ReadDir(dirS.path)
+			id, err = param.Store.AddLeak(leakRows{Name: dirS.name,
+				Parent:     dirS.parent,
+				FileName:   dirS.file,
+				Member:     dirS.member,
+				HashID:     hash,
+				Date:       fmt.Sprint(time.Now()),
+				Website:    "reddit",
+				LineNumber: lineNum,
+				Status:     1})
 			if err != nil {
-				CheckErr(err, "Error", fmt.Sprint("Could not open directory:", dirS.path))
+				// without its row the leak has no id to write its creds and status to
+				CheckErrWith(leakFields(dirS), err, "Error", "Could not add the leak to the database, it is skipped")
 				continue
 			}
+		}
 
-			for _, f := range files {
-				if strings.Contains(f.Name(), ".txt") {
-					dirS.file = f.Name()
-
-					h.Write([]byte(fmt.Sprint(dirS.parent, dirS.name, dirS.file)))
-					hash := hex.EncodeToString(h.Sum(nil))
-
-					id, err = GetForeignKey(param.DB, "leaks", "hashID", hash)
-
-					if err != nil {
-						Logg(fmt.Sprint("adding file to db: ", dirS.parent, dirS.name, dirS.file, " ", id), "Debug")
-						lineNum, err = LineCounter(filepath.Join(*Path, dirS.parent, dirS.name, dirS.file))
-						CheckErr(err, "Warn", "Trying to count number of lines in file")
-
-						err = InsertRow(param.DB, leaksTable, []leakRows{{Name: dirS.name,
-							Parent:     dirS.parent,
-							FileName:   dirS.file,
-							HashID:     hash,
-							Date:       fmt.Sprint(time.Now()),
-							Website:    "reddit",
-							LineNumber: lineNum,
-							Status:     1}})
-
-						CheckErr(err, "Warn", fmt.Sprintf("Could not add row"))
-						id, err = GetForeignKey(param.DB, "leaks", "hashID", hash)
-						CheckErr(err, "Warn", fmt.Sprintf("Could not get leakid"))
-
-					}
-
-					dirS.leakID = id
-				}
-
-				status, err = ReadStatus(param.DB, id)
-				CheckErr(err, "Warn", fmt.Sprintf("Could not get leaks status with id %v, ", id))
-				if status != 3 {
-					sliceDir = append(sliceDir, dirS)
-				}
-
-			}
+		dirS.leakID = id
 
+		status, err = param.Store.LeakStatus(id)
+		CheckErrWith(leakFields(dirS), err, "Warn", "Could not get the status of the leak")
+		if status == 4 && !*RetryFailed {
+			LoggWith(leakFields(dirS), "Skipping failed leak, -retry-failed to read it again", "Debug")
+			continue
+		}
+		if status == 2 || status == 4 {
+			dirS.checkpoint, err = param.Store.ReadCheckpoint(id)
+			CheckErrWith(leakFields(dirS), err, "Warn", "Could not read the checkpoint of the leak, starting it from the top")
+		}
+		if status != 3 {
+			sliceDir = append(sliceDir, dirS)
 		}
 
 	}
@@ -227,10 +255,30 @@ func scanWorkingDir(param JobParam) {
 	Logg("Stating job!", "Info")
 
 	startTime := time.Now()
-	startProducer(&param)
+	summary := startProducer(ctx, &param)
 	endTime := time.Now()
 	timeDelta := endTime.Sub(startTime)
 
+	if ctx.Err() != nil {
+		Logg(fmt.Sprintf("Interrupted after %s: %v leaks done, %v failed, %v stopped in the middle and %v not started, the next ingest resumes them",
+			timeDelta, summary.done, summary.failed, summary.stopped, len(sliceDir)-summary.done-summary.failed-summary.stopped), "Warn")
+		return true, nil
+	}
+	if summary.failed > 0 {
+		Logg(fmt.Sprintf("%v leaks failed, see 'leaks list -failed' and ingest -retry-failed", summary.failed), "Warn")
+	}
 	Logg(fmt.Sprintf("Finished job at %s - It took %s", endTime, timeDelta), "Info")
+	return false, nil
 
 }
+
+// removeDB deletes the SQLite file at path with its WAL, which would be replayed into a new database of the same name
+func removeDB(path string) error {
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
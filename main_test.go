@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	// the tests only want to hear about what goes wrong
+	log.SetOutput(ioutil.Discard)
+}
+
+/*
+testConfig sets the config to the defaults of the ingest flags, with args on top, as if
+the test was "tr4ilgo ingest args...". The config before is put back at the end of the test.
+*/
+func testConfig(t testing.TB, args ...string) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	fs := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	ingestFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatalf("bad test flags %v: %s", args, err)
+	}
+}
+
+// testStore opens a new SQLite store in a temporary directory, see testOpenStore
+func testStore(t testing.TB) Store {
+	t.Helper()
+	return testOpenStore(t, filepath.Join(t.TempDir(), "creds.db"))
+}
+
+/*
+testOpenStore opens the SQLite store at path, made if needed, set up the way runIngest
+does it (hash version, password policy, encryption). Call testConfig before, -d is set
+to path. The store is closed at the end of the test.
+*/
+func testOpenStore(t testing.TB, path string) Store {
+	t.Helper()
+	*DBName = path
+	store, err := openStore(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	db := store.Meta()
+	err = checkHashVersion(db)
+	if err == nil {
+		err = rehashLeaks(db)
+	}
+	if err == nil {
+		err = setPasswordPolicy(db)
+	}
+	if err == nil {
+		credCrypt, err = setEncryption(db)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// testLeak adds the leak name to the store and returns its id
+func testLeak(t testing.TB, store Store, name string) int {
+	t.Helper()
+	id, err := store.AddLeak(leakRows{Name: name, Parent: "test", FileName: name, HashID: leakHashID("test", name, name, ""), Status: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// testCred is the record a worker sends for the line of leakID with email and password
+func testCred(leakID, line int, email, password string) record {
+	hasher := newCredHasher()
+	username, domain, _ := splitEmail(email)
+	identity := hasher.IdentityID(email)
+	passwordID := hasher.PasswordID(password)
+	return record{
+		kind:     recordCred,
+		identity: identityRows{HashID: identity, Local: username},
+		password: passwordRows{HashID: passwordID, Password: password},
+		sighting: sightingRows{Leak: leakID, Line: line},
+		domain:   domain,
+		line:     line,
+		offset:   int64(line * 100),
+		counts:   leakCounts{parsed: line},
+	}
+}
+
+// testCount returns the number of rows of table in the store
+func testCount(t testing.TB, store Store, table string) int {
+	t.Helper()
+	var n int
+	err := store.Meta().QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+/*
+testDump writes a leak of lines email:pass lines at dir/name and returns its size. Every
+line is a new cred, the domains go round a thousand of them.
+*/
+func testDump(t testing.TB, dir, name string, lines int) int64 {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(w, "user%d@domain%d.com:password%d\n", i, i%1000, i)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// testIngest reads the leaks under -u/-p into store, as an ingest does, interrupted tells if ctx was cancelled
+func testIngest(t testing.TB, ctx context.Context, store Store) bool {
+	t.Helper()
+	interrupted, err := scanWorkingDir(ctx, JobParam{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return interrupted
+}
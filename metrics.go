@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+The metrics of an ingest, for Prometheus: "ingest -metrics localhost:9100" serves them on
+/metrics while it runs. They are kept even without -metrics, it is only a few counters.
+
+The lines are counted by the workers as they read them, the creds by the writer once
+they are written. Per second rates are left to Prometheus (rate()), except the inserts
+per second the writer already logs.
+*/
+
+var (
+	metricLines = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tr4ilgo_lines_total",
+		Help: "Lines of the leaks read by the workers, by what became of them: read, parsed or rejected.",
+	}, []string{"state"})
+
+	metricCreds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tr4ilgo_creds_total",
+		Help: "Creds written by the writer: inserted (new) or duplicate (already in the database). With -bulk the duplicates are only known at the merge.",
+	}, []string{"state"})
+
+	metricInsertRate = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tr4ilgo_inserts_per_second",
+		Help: "New creds written per second since the last report of the writer.",
+	})
+
+	metricBatchSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tr4ilgo_batch_duration_seconds",
+		Help:    "Time the writer takes to write a batch of creds (write) and to commit its transaction (commit).",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"op"})
+
+	metricSQLiteBusy = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tr4ilgo_sqlite_busy_total",
+		Help: "SQLite statements that returned busy or locked, another process still had the database after busy_timeout.",
+	})
+
+	metricSQLiteRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tr4ilgo_sqlite_retries_total",
+		Help: "SQLite transactions begun again after SQLite returned busy, see sqliteBusyRetries.",
+	})
+
+	metricRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tr4ilgo_leak_retries_total",
+		Help: "Leaks read again by a worker after they failed, see -retries. It is not about SQLite, see tr4ilgo_sqlite_retries_total.",
+	})
+
+	metricQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tr4ilgo_queue_depth",
+		Help: "Items waiting in the queues of the ingest: work (leaks not taken by a worker), result (results of the workers) and records (lines for the writer).",
+	}, []string{"queue"})
+
+	metricWorkerBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tr4ilgo_worker_busy_seconds_total",
+		Help: "Time each worker spent reading a leak, added every -b lines, its utilisation is the rate of it.",
+	}, []string{"worker"})
+)
+
+// queueSampleEvery is how often the depths of the result and records queues are read
+const queueSampleEvery = time.Second
+
+// serveMetrics serves /metrics on addr (-metrics) until the program exits
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	Logg("Serving the metrics on http://"+addr+"/metrics", "Info")
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		CheckErr(err, "Error", "The metrics endpoint stopped")
+	}()
+}
+
+// sampleQueues sets the depth of the queues every queueSampleEvery until ctx is done
+func sampleQueues(ctx context.Context, results chan workOutput, records chan record) {
+	ticker := time.NewTicker(queueSampleEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metricQueueDepth.WithLabelValues("result").Set(float64(len(results)))
+			metricQueueDepth.WithLabelValues("records").Set(float64(len(records)))
+		}
+	}
+}
+
+// workerBusy returns the counter of the time worker id spent reading
+func workerBusy(id int) prometheus.Counter {
+	return metricWorkerBusy.WithLabelValues(strconv.Itoa(id))
+}
+
+// isBusy tells if err is a SQLite busy or locked error
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// countBusy counts err in metricSQLiteBusy if it is a SQLite busy or locked error, and returns it
+func countBusy(err error) error {
+	if isBusy(err) {
+		metricSQLiteBusy.Inc()
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+/*
+a transaction that finds the database locked by another process is begun again
+sqliteBusyRetries times, every busy counted, and goes on once the lock is gone
+*/
+func TestBeginBusy(t *testing.T) {
+	saved := sqliteBusyTimeout
+	sqliteBusyTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { sqliteBusyTimeout = saved })
+	testConfig(t)
+	path := filepath.Join(t.TempDir(), "creds.db")
+	store := testOpenStore(t, path)
+
+	other, err := sql.Open(sqliteDriver(), sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	lock, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busy := testutil.ToFloat64(metricSQLiteBusy)
+	retries := testutil.ToFloat64(metricSQLiteRetries)
+	_, err = store.Begin()
+	if !isBusy(err) {
+		t.Fatalf("begin while locked returned %v, want busy", err)
+	}
+	if n := testutil.ToFloat64(metricSQLiteBusy) - busy; n != sqliteBusyRetries+1 {
+		t.Errorf("%v busy counted, want %v", n, sqliteBusyRetries+1)
+	}
+	if n := testutil.ToFloat64(metricSQLiteRetries) - retries; n != sqliteBusyRetries {
+		t.Errorf("%v retries counted, want %v", n, sqliteBusyRetries)
+	}
+
+	// the lock is let go while the store tries again
+	retries = testutil.ToFloat64(metricSQLiteRetries)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		lock.Rollback()
+	}()
+	tx, err := store.Begin()
+	if err != nil {
+		t.Fatalf("begin after the lock was let go: %s", err)
+	}
+	tx.Rollback()
+	if n := testutil.ToFloat64(metricSQLiteRetries) - retries; n < 1 {
+		t.Errorf("%v retries counted, want the ones while locked", n)
+	}
+}
+
+// the busy time of a worker grows while it reads a leak, not only once it is done
+func TestWorkerBusyPerBatch(t *testing.T) {
+	const lines, checkAt = 1000, 500
+	const id = 9001 // a worker of its own in the metrics
+	testConfig(t, "-u", t.TempDir(), "-p", "leaks", "-b", "100")
+	store := testStore(t)
+	jobs := testJobs(t, store, 1, lines)
+
+	records := make(chan record)
+	work := make(chan workRequest, 1)
+	results := make(chan workOutput, 1)
+	work <- workRequest{Job: jobs[0]}
+	close(work)
+	w := workerNew(context.Background(), id, records)
+	go func() {
+		w.Run(work, results)
+		close(records)
+	}()
+
+	before := testutil.ToFloat64(workerBusy(id))
+	var during float64
+	creds := 0
+	for r := range records {
+		if r.kind == recordCred {
+			creds++
+			if creds == checkAt {
+				during = testutil.ToFloat64(workerBusy(id))
+			}
+		}
+	}
+	after := testutil.ToFloat64(workerBusy(id))
+	if r := <-results; r.Error != nil {
+		t.Fatal(r.Error)
+	}
+
+	if during <= before {
+		t.Errorf("busy time %v after %v lines of %v, want it to grow before the end of the leak", during-before, checkAt, lines)
+	}
+	if after < during {
+		t.Errorf("busy time went down from %v to %v", during, after)
+	}
+}
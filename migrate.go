@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+The schema of the database is built by migrations: numbered, ordered steps that are part
+of the binary. Every database has a schema_version table with one row per migration
+applied. When a database is opened the missing migrations are applied, each in its own
+transaction, so a schema change never needs -r (which deletes everything) again.
+
+Migrations are never edited once released, a change of the schema is a new migration at
+the end of the list. Version 1 is the schema of the first tr4ilGo.
+
+Databases made before schema_version existed are given their version by looking at what
+they have (see migration.present), then migrated like the others.
+*/
+
+type migration struct {
+	version int
+	name    string
+	steps   []string
+	present string // query that only works once the migration is in, empty for the ones that only change rows
+}
+
+var migrations = []migration{
+	{version: 1, name: "initial schema",
+		steps: []string{
+			`CREATE TABLE hosts (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"domain" TEXT UNIQUE,
+		"smtp" TEXT,
+		"smtpPort" INTEGER,
+		"imap" TEXT,
+		"imapPort" INTEGER
+	  );`,
+			`CREATE TABLE leaks (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"name" TEXT NOT NULL,
+		"parent" TEXT NOT NULL,
+		"filename" TEXT NOT NULL,
+		"hashID" TEXT UNIQUE NOT NULL,
+		"date" TEXT,
+		"website" TEXT,
+		"linenumber" INTEGER,
+		"status" INTEGER
+	  );`,
+			`CREATE TABLE creds (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"email" TEXT NOT NULL,
+		"username" TEXT,
+		"password" TEXT,
+		"hashID" TEXT NOT NULL UNIQUE,
+		"valid" INTEGER NOT NULL DEFAULT 0,
+		"host" INTEGER,
+		"firstSeen" TEXT,
+		"leak" INTEGER,
+		FOREIGN KEY(host) REFERENCES hosts(id),
+		FOREIGN KEY(leak) REFERENCES leaks(id)
+	  );`,
+		},
+		present: "SELECT id FROM creds LIMIT 0"},
+
+	{version: 2, name: "archive members",
+		steps: []string{
+			`ALTER TABLE leaks ADD COLUMN "member" TEXT NOT NULL DEFAULT ''`,
+		},
+		present: "SELECT member FROM leaks LIMIT 0"},
+
+	{version: 3, name: "stealer log urls",
+		steps: []string{
+			`ALTER TABLE creds ADD COLUMN "url" TEXT`,
+		},
+		present: "SELECT url FROM creds LIMIT 0"},
+
+	{version: 4, name: "rejected lines",
+		steps: []string{
+			`ALTER TABLE leaks ADD COLUMN "parsed" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE leaks ADD COLUMN "duplicates" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE leaks ADD COLUMN "rejected" INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE rejects (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"leak" INTEGER NOT NULL,
+		"line" INTEGER,
+		"reason" TEXT NOT NULL,
+		"content" TEXT,
+		UNIQUE(leak, line),
+		FOREIGN KEY(leak) REFERENCES leaks(id)
+	  );`,
+		},
+		present: "SELECT id FROM rejects LIMIT 0"},
+
+	{version: 5, name: "sightings",
+		steps: []string{
+			`CREATE TABLE creds_leaks (
+		"cred" INTEGER NOT NULL,
+		"leak" INTEGER NOT NULL,
+		"line" INTEGER,
+		PRIMARY KEY(cred, leak),
+		FOREIGN KEY(cred) REFERENCES creds(id),
+		FOREIGN KEY(leak) REFERENCES leaks(id)
+	  );`,
+			// until now a cred only knew the leak it was first seen in
+			"INSERT OR IGNORE INTO creds_leaks(cred, leak) SELECT id, leak FROM creds WHERE leak > 0",
+		},
+		present: "SELECT cred FROM creds_leaks LIMIT 0"},
+
+	{version: 6, name: "metadata",
+		steps: []string{
+			`CREATE TABLE metadata (
+		"key" TEXT NOT NULL PRIMARY KEY,
+		"value" TEXT
+	  );`,
+		},
+		present: "SELECT key FROM metadata LIMIT 0"},
+
+	{version: 7, name: "checkpoints",
+		steps: []string{
+			`ALTER TABLE leaks ADD COLUMN "byteoffset" INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE leaks ADD COLUMN "lineoffset" INTEGER NOT NULL DEFAULT 0`,
+		},
+		present: "SELECT byteoffset FROM leaks LIMIT 0"},
+
+	// the creds of the old tables are moved over by convertCreds, it needs the keys
+	{version: 8, name: "normalised schema",
+		steps: []string{
+			"ALTER TABLE creds_leaks RENAME TO creds_leaks_v1",
+			"ALTER TABLE creds RENAME TO creds_v1",
+			"ALTER TABLE hosts RENAME TO hosts_v1",
+			`CREATE TABLE domains (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"domain" TEXT NOT NULL UNIQUE
+	  );`,
+			// same ids as hosts, creds_v1.host can be used as it is
+			"INSERT INTO domains(id, domain) SELECT id, domain FROM hosts_v1 WHERE domain IS NOT NULL",
+			`CREATE TABLE identities (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"hashID" TEXT NOT NULL UNIQUE,
+		"local" TEXT NOT NULL,
+		"domain_id" INTEGER,
+		FOREIGN KEY(domain_id) REFERENCES domains(id)
+	  );`,
+			"CREATE INDEX identities_domain ON identities(domain_id)",
+			`CREATE TABLE passwords (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"hashID" TEXT NOT NULL UNIQUE,
+		"password" TEXT
+	  );`,
+			`CREATE TABLE sightings (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		"identity" INTEGER NOT NULL,
+		"password" INTEGER NOT NULL,
+		"leak" INTEGER NOT NULL,
+		"line" INTEGER,
+		"url" TEXT,
+		"firstSeen" TEXT,
+		UNIQUE(identity, password, leak),
+		FOREIGN KEY(identity) REFERENCES identities(id),
+		FOREIGN KEY(password) REFERENCES passwords(id),
+		FOREIGN KEY(leak) REFERENCES leaks(id)
+	  );`,
+			"CREATE INDEX sightings_leak ON sightings(leak)",
+			// the old tables, as views for the scripts reading them
+			`CREATE VIEW creds AS SELECT
+		c.id AS id,
+		i.local || coalesce('@' || d.domain, '') AS email,
+		i.local AS username,
+		p.password AS password,
+		c.url AS url,
+		i.hashID || '/' || p.hashID AS hashID,
+		0 AS valid,
+		i.domain_id AS host,
+		c.firstSeen AS firstSeen,
+		f.leak AS leak
+		FROM (SELECT min(id) AS id, max(url) AS url, min(firstSeen) AS firstSeen
+			FROM sightings GROUP BY identity, password) c
+		JOIN sightings f ON f.id = c.id
+		JOIN identities i ON i.id = f.identity
+		JOIN passwords p ON p.id = f.password
+		LEFT JOIN domains d ON d.id = i.domain_id`,
+			`CREATE VIEW creds_leaks AS SELECT
+		(SELECT min(f.id) FROM sightings f WHERE f.identity = s.identity AND f.password = s.password) AS cred,
+		s.leak AS leak,
+		s.line AS line
+		FROM sightings s`,
+			`CREATE VIEW hosts AS SELECT id, domain,
+		NULL AS smtp, NULL AS smtpPort, NULL AS imap, NULL AS imapPort
+		FROM domains`,
+		},
+		present: "SELECT id FROM sightings LIMIT 0"},
+
+	// where ingest -bulk puts the creds until the end of the load, see bulk.go
+	{version: 9, name: "bulk load",
+		steps: []string{
+			`CREATE TABLE bulk_sightings (
+		"id" INTEGER NOT NULL PRIMARY KEY,
+		"identity_hash" TEXT NOT NULL,
+		"local" TEXT NOT NULL,
+		"domain" TEXT NOT NULL,
+		"password_hash" TEXT NOT NULL,
+		"password" TEXT,
+		"leak" INTEGER NOT NULL,
+		"line" INTEGER,
+		"url" TEXT,
+		"firstSeen" TEXT
+	  );`,
+		},
+		present: "SELECT id FROM bulk_sightings LIMIT 0"},
+
+	// leaks that could not be read have status 4, see ingest -retry-failed
+	{version: 10, name: "failed leaks",
+		steps: []string{
+			`ALTER TABLE leaks ADD COLUMN "error" TEXT`,
+			`ALTER TABLE leaks ADD COLUMN "attempts" INTEGER NOT NULL DEFAULT 0`,
+		},
+		present: "SELECT attempts FROM leaks LIMIT 0"},
+
+	// the domains are written in lowercase, the ones of before are merged with their lowercase twin
+	{version: 11, name: "lowercase domains",
+		steps: []string{
+			`UPDATE identities SET domain_id = (SELECT min(k.id) FROM domains k JOIN domains d ON lower(k.domain) = lower(d.domain)
+			WHERE d.id = identities.domain_id)
+			WHERE domain_id NOT IN (SELECT min(id) FROM domains GROUP BY lower(domain))`,
+			"DELETE FROM domains WHERE id NOT IN (SELECT min(id) FROM domains GROUP BY lower(domain))",
+			"UPDATE domains SET domain = lower(domain) WHERE domain <> lower(domain)",
+			"UPDATE bulk_sightings SET domain = lower(domain) WHERE domain <> lower(domain)",
+		}},
+}
+
+const createSchemaVersionSQL = `CREATE TABLE IF NOT EXISTS schema_version (
+		"version" INTEGER NOT NULL PRIMARY KEY,
+		"name" TEXT NOT NULL,
+		"applied" TEXT NOT NULL
+	  );`
+
+/*
+schemaVersion returns the version of the database, 0 for an empty one. known tells if
+it comes from schema_version, or was found from the tables of an older database.
+*/
+func schemaVersion(db *sql.DB) (version int, known bool, err error) {
+	var n int
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&n)
+	if err != nil {
+		return 0, false, err
+	}
+	if n > 0 {
+		err = db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version)
+		return version, true, err
+	}
+
+	// the migrations up to the first one missing are in
+	for _, m := range migrations {
+		if m.present == "" {
+			break
+		}
+		rows, err := db.Query(m.present)
+		if err != nil {
+			break
+		}
+		rows.Close()
+		version = m.version
+	}
+	return version, false, nil
+}
+
+// pendingMigrations returns the migrations the database does not have yet
+func pendingMigrations(db *sql.DB) (pending []migration, version int, known bool, err error) {
+	version, known, err = schemaVersion(db)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	last := migrations[len(migrations)-1].version
+	if version > last {
+		return nil, version, known, fmt.Errorf("%s has schema version %v, this tr4ilGo only knows up to %v", *DBName, version, last)
+	}
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, version, known, nil
+}
+
+/*
+migrateDB applies the pending migrations and returns how many there were. An older
+database without schema_version first gets the versions it was found to have.
+*/
+func migrateDB(db *sql.DB) (applied int, err error) {
+	pending, version, known, err := pendingMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+
+	if !known {
+		tx, err := db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(createSchemaVersionSQL)
+		for _, m := range migrations {
+			if err != nil || m.version > version {
+				break
+			}
+			_, err = tx.Exec("INSERT INTO schema_version(version, name, applied) VALUES (?, ?, ?)", m.version, m.name+" (found)", time.Now().Format(firstSeenLayout))
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return 0, err
+		}
+		if version > 0 {
+			Logg(fmt.Sprintf("%s had no schema version, found version %v", *DBName, version), "Info")
+		}
+	}
+
+	for _, m := range pending {
+		err = applyMigration(db, m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %v (%s): %s", m.version, m.name, err)
+		}
+		applied++
+		Logg(fmt.Sprintf("%s migrated to version %v (%s)", *DBName, m.version, m.name), "Info")
+	}
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, step := range m.steps {
+		_, err = tx.Exec(step)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_version(version, name, applied) VALUES (?, ?, ?)", m.version, m.name, time.Now().Format(firstSeenLayout))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrationSQL is the SQL of the migrations, as printed by db migrate -dry-run
+func migrationSQL(pending []migration) string {
+	var b strings.Builder
+	for _, m := range pending {
+		fmt.Fprintf(&b, "-- %v: %s\n", m.version, m.name)
+		for _, step := range m.steps {
+			fmt.Fprintf(&b, "%s;\n", strings.TrimSuffix(strings.TrimSpace(step), ";"))
+		}
+		fmt.Fprintf(&b, "INSERT INTO schema_version(version, name, applied) VALUES (%v, '%s', datetime('now'));\n\n", m.version, m.name)
+	}
+	return b.String()
+}
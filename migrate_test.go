@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testV1DB makes a database of the first tr4ilGo from testdata/schema/v1.sql
+func testV1DB(t *testing.T) *sql.DB {
+	t.Helper()
+	fixture, err := ioutil.ReadFile(filepath.Join("testdata", "schema", "v1.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*DBName = filepath.Join(t.TempDir(), "v1.db")
+	db, err := sql.Open(sqliteDriver(), *DBName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(string(fixture))
+	if err != nil {
+		t.Fatalf("could not load the v1 fixture: %s", err)
+	}
+	return db
+}
+
+/*
+TestMigrateV1Fixture upgrades a database of the first tr4ilGo (no schema_version) the way
+db migrate does: its version is found from its tables, the migrations after it are
+applied, then its creds are moved to the normalised tables and read back through the
+creds, creds_leaks and hosts views.
+*/
+func TestMigrateV1Fixture(t *testing.T) {
+	testConfig(t)
+	db := testV1DB(t)
+
+	version, known, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || known {
+		t.Fatalf("v1 fixture has version %v (known %v), want 1 found from its tables", version, known)
+	}
+
+	applied, err := migrateDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := migrations[len(migrations)-1].version
+	if applied != last-1 {
+		t.Errorf("%v migrations applied, want %v", applied, last-1)
+	}
+
+	// one row per migration, the first one found and the others applied
+	rows, err := db.Query("SELECT version, name FROM schema_version ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []int
+	for rows.Next() {
+		var v int
+		var name string
+		err = rows.Scan(&v, &name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := migrations[len(versions)].name
+		if v == 1 {
+			want += " (found)"
+		}
+		if v != migrations[len(versions)].version || name != want {
+			t.Errorf("schema_version row %v is %v %q, want %v %q", len(versions)+1, v, name, migrations[len(versions)].version, want)
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if len(versions) != len(migrations) {
+		t.Errorf("%v rows in schema_version, want %v", len(versions), len(migrations))
+	}
+
+	// migrating again does nothing
+	applied, err = migrateDB(db)
+	if err != nil || applied != 0 {
+		t.Errorf("second migration applied %v: %v, want none", applied, err)
+	}
+
+	legacy, err := legacyCreds(db)
+	if err != nil || !legacy {
+		t.Fatalf("legacy creds %v: %v, want the creds of the fixture", legacy, err)
+	}
+	var before, after int
+	err = db.QueryRow("SELECT count(*) FROM creds_v1").Scan(&before)
+	if err != nil || before != 3 {
+		t.Fatalf("%v creds in creds_v1 (%v), want the 3 of the fixture", before, err)
+	}
+	n, err := convertCreds(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != before {
+		t.Errorf("%v creds moved, want %v", n, before)
+	}
+	err = db.QueryRow("SELECT count(*) FROM creds").Scan(&after)
+	if err != nil || after != before {
+		t.Errorf("%v creds after the move (%v), want the %v of before", after, err, before)
+	}
+	err = checkBatchWriters(db)
+	if err != nil {
+		t.Errorf("batch writers do not match the migrated schema: %s", err)
+	}
+
+	type cred struct {
+		email, username, password string
+		host, leak                int
+		firstSeen                 string
+	}
+	// the creds had leak 0, they are all in the leak legacy (4)
+	want := []cred{
+		{"john@example.com", "john", "hunter2", 1, 4, "2021-03-04 10:00:01.101 +0100 CET m=+1.001"},
+		{"jane@example.com", "jane", "p@ss:word", 1, 4, "2021-03-04 10:00:01.102 +0100 CET m=+1.002"},
+		{"bob@mail.org", "bob", "secret", 2, 4, "2021-03-04 10:00:02.201 +0100 CET m=+2.101"},
+	}
+	rows, err = db.Query("SELECT email, username, password, host, leak, firstSeen FROM creds ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []cred
+	for rows.Next() {
+		var c cred
+		err = rows.Scan(&c.email, &c.username, &c.password, &c.host, &c.leak, &c.firstSeen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+	}
+	rows.Close()
+	if len(got) != len(want) {
+		t.Fatalf("creds view has %v rows, want %v: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("creds view row %v is %+v, want %+v", i+1, got[i], want[i])
+		}
+	}
+
+	var credsLeaks, hosts int
+	err = db.QueryRow("SELECT count(*) FROM creds_leaks").Scan(&credsLeaks)
+	if err == nil {
+		err = db.QueryRow("SELECT count(*) FROM hosts WHERE domain IN ('example.com', 'mail.org')").Scan(&hosts)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credsLeaks != 3 || hosts != 2 {
+		t.Errorf("views have %v creds_leaks and %v hosts, want 3 and 2", credsLeaks, hosts)
+	}
+	if legacy, _ := legacyCreds(db); legacy {
+		t.Error("the v1 tables are still there after the move")
+	}
+}
+
+// a cred with a leak keeps it, the creds of the old versions (leak 0, no creds_leaks row) get a sighting in the leak "legacy"
+func TestConvertCredsUnknownLeak(t *testing.T) {
+	testConfig(t)
+	db := testV1DB(t)
+	_, err := migrateDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE creds_v1 SET leak = 1 WHERE id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := convertCreds(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("%v creds moved, want 3", n)
+	}
+	rows, err := db.Query("SELECT l.name, count(*) FROM sightings s JOIN leaks l ON l.id = s.leak GROUP BY l.name ORDER BY l.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for rows.Next() {
+		var name string
+		var count int
+		err = rows.Scan(&name, &count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[name] = count
+	}
+	rows.Close()
+	if len(got) != 2 || got["combo"] != 1 || got["legacy"] != 2 {
+		t.Errorf("sightings per leak %v, want 1 in combo and 2 in legacy", got)
+	}
+	if legacy, _ := legacyCreds(db); legacy {
+		t.Error("the v1 tables are still there after the move")
+	}
+}
+
+// the domains of before v11 differ only by their case, the migration keeps one lowercase row and moves the identities to it
+func TestMigrateLowercaseDomains(t *testing.T) {
+	testConfig(t)
+	store := testStore(t)
+	db := store.(*sqliteStore).db
+
+	for _, q := range []string{
+		"INSERT INTO domains(id, domain) VALUES (1, 'Example.com'), (2, 'example.com'), (3, 'EXAMPLE.COM'), (4, 'Mail.org')",
+		"INSERT INTO identities(hashID, local, domain_id) VALUES ('a', 'a', 1), ('b', 'b', 2), ('c', 'c', 3), ('d', 'd', 4)",
+		"DELETE FROM schema_version WHERE version = 11",
+	} {
+		_, err := db.Exec(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	applied, err := migrateDB(db)
+	if err != nil || applied != 1 {
+		t.Fatalf("migration applied %v: %v, want the lowercase one", applied, err)
+	}
+
+	rows, err := db.Query("SELECT i.hashID, d.id, d.domain FROM identities i JOIN domains d ON d.id = i.domain_id ORDER BY i.hashID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	ids := map[string]int{}
+	for rows.Next() {
+		var hashID, domain string
+		var id int
+		err = rows.Scan(&hashID, &id, &domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hashID] = domain
+		ids[domain] = id
+	}
+	rows.Close()
+	want := map[string]string{"a": "example.com", "b": "example.com", "c": "example.com", "d": "mail.org"}
+	for h, d := range want {
+		if got[h] != d {
+			t.Errorf("identity %v has domain %q, want %q", h, got[h], d)
+		}
+	}
+	if ids["example.com"] != 1 {
+		t.Errorf("example.com has id %v, want 1, the first of its rows", ids["example.com"])
+	}
+	if n := testCount(t, store, "domains"); n != 2 {
+		t.Errorf("%v domains after the migration, want 2", n)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	parquetwriter "github.com/xitongsys/parquet-go/writer"
+)
+
+/*
+With -parquet, ingest also writes every sighting it commits to a Parquet file, one flat
+row per cred and leak, for the analytics tools (DuckDB, Spark, pandas...). Every ingest
+makes a new file in the -parquet directory, tr4il-<date>.parquet, so the directory is a
+dataset that grows with the ingests: "SELECT domain, count(*) FROM 'dir/*.parquet'".
+
+The rows are written once the transaction they were in is committed to the store. They
+are what the store holds: hashIDs, the local part and password as stored (encrypted with
+-encrypt, after the -passwords policy), and the leak id of the leaks table. The creds
+already in the store are written again, the file is not deduped. A file is only readable
+once ingest closed it, an ingest stopped in the middle leaves a file without its footer.
+*/
+
+// parquetCred is a row of the Parquet files
+type parquetCred struct {
+	Leak       int64  `parquet:"name=leak, type=INT64"`
+	Line       int64  `parquet:"name=line, type=INT64"`
+	Identity   string `parquet:"name=identity, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Local      string `parquet:"name=local, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Domain     string `parquet:"name=domain, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	PasswordID string `parquet:"name=password_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Password   string `parquet:"name=password, type=BYTE_ARRAY, convertedtype=UTF8"`
+	URL        string `parquet:"name=url, type=BYTE_ARRAY, convertedtype=UTF8"`
+	FirstSeen  string `parquet:"name=first_seen, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// parquetWriters is the number of goroutines encoding the columns
+const parquetWriters = 4
+
+type parquetSink struct {
+	path string
+	file *os.File
+	pw   *parquetwriter.ParquetWriter
+	rows int
+}
+
+// newParquetSink creates the Parquet file of this ingest in dir
+func newParquetSink(dir string) (*parquetSink, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("tr4il-%s.parquet", time.Now().Format("20060102-150405")))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := parquetwriter.NewParquetWriterFromWriter(file, new(parquetCred), parquetWriters)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	Logg(fmt.Sprintf("Writing the creds to %s", path), "Info")
+	return &parquetSink{path: path, file: file, pw: pw}, nil
+}
+
+// Write adds the creds to the file
+func (p *parquetSink) Write(creds []record) error {
+	for _, r := range creds {
+		firstSeen := r.sighting.FirstSeen
+		// time.Time.String() adds the monotonic clock reading, it means nothing once stored
+		if i := strings.Index(firstSeen, " m="); i >= 0 {
+			firstSeen = firstSeen[:i]
+		}
+		err := p.pw.Write(parquetCred{
+			Leak:       int64(r.sighting.Leak),
+			Line:       int64(r.sighting.Line),
+			Identity:   r.identity.HashID,
+			Local:      r.identity.Local,
+			Domain:     r.domain,
+			PasswordID: r.password.HashID,
+			Password:   r.password.Password,
+			URL:        r.sighting.URL,
+			FirstSeen:  firstSeen,
+		})
+		if err != nil {
+			return fmt.Errorf("writing %s: %s", p.path, err)
+		}
+		p.rows++
+	}
+	return nil
+}
+
+// Close writes the footer of the file, it cannot be read before
+func (p *parquetSink) Close() error {
+	err := p.pw.WriteStop()
+	if e := p.file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("closing %s: %s", p.path, err)
+	}
+	Logg(fmt.Sprintf("%v creds written to %s", p.rows, p.path), "Info")
+	return nil
+}
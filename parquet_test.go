@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// the creds of an ingest with -parquet are read back from the file as they were written to the database
+func TestParquetRoundTrip(t *testing.T) {
+	const lines = 1000
+	root := t.TempDir()
+	testConfig(t, "-u", root, "-p", "leaks", "-b", "100")
+	store := testStore(t)
+	testDump(t, filepath.Join(root, "leaks", "dump"), "dump.txt", lines)
+
+	sink, err := newParquetSink(filepath.Join(root, "parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = scanWorkingDir(context.Background(), JobParam{Store: store, Sink: sink})
+	if err == nil {
+		err = sink.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := local.NewLocalFileReader(sink.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pr, err := reader.NewParquetReader(file, new(parquetCred), parquetWriters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	if n := pr.GetNumRows(); n != lines {
+		t.Fatalf("%v rows in the Parquet file, want %v", n, lines)
+	}
+	creds := make([]parquetCred, lines)
+	err = pr.Read(&creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(creds, func(i, j int) bool { return creds[i].Line < creds[j].Line })
+
+	leakID, err := store.LeakID(leakHashID("leaks", "dump", "dump.txt", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher := newCredHasher()
+	for i, c := range creds {
+		email := fmt.Sprintf("user%d@domain%d.com", i, i%1000)
+		want := parquetCred{
+			Leak:       int64(leakID),
+			Line:       int64(i + 1),
+			Identity:   hasher.IdentityID(email),
+			Local:      fmt.Sprintf("user%d", i),
+			Domain:     fmt.Sprintf("domain%d.com", i%1000),
+			PasswordID: hasher.PasswordID(fmt.Sprintf("password%d", i)),
+			Password:   fmt.Sprintf("password%d", i),
+			FirstSeen:  c.FirstSeen,
+		}
+		if c != want {
+			t.Errorf("row %v is %+v, want %+v", i+1, c, want)
+		}
+		if c.FirstSeen == "" || strings.Contains(c.FirstSeen, " m=") {
+			t.Errorf("row %v has first_seen %q, want a date without the monotonic clock", i+1, c.FirstSeen)
+		}
+	}
+
+	// every row is a sighting of the database
+	var sightings int
+	err = store.Meta().QueryRow(`SELECT count(*) FROM sightings s JOIN identities i ON i.id = s.identity
+		JOIN passwords p ON p.id = s.password WHERE s.leak = ?`, leakID).Scan(&sightings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sightings != lines {
+		t.Errorf("%v sightings in the database, want the %v rows of the file", sightings, lines)
+	}
+}
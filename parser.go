@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+LineParser turns one line of a leak file into a credential. Each format of line we
+know about (email:pass, user:pass, csv with a header...) has its own parser in the
+lineParsers registry. The parser of a file is chosen by sniffing its first lines, or
+forced with -format / -formats.
+*/
+type LineParser interface {
+	Name() string
+	Parse(line string) (credential, error)
+}
+
+// credential is what a LineParser gets out of a line
+type credential struct {
+	Email    string
+	Username string
+	Domain   string
+	Password string
+	URL      string // only for stealer logs
+}
+
+var (
+	errHeader      = errors.New("header line")
+	errNoSeparator = errors.New("no separator in line")
+	errBadEmail    = errors.New("not a valid email")
+	errNoHeader    = errors.New("no header found before the first line")
+	errBadFields   = errors.New("wrong number of fields")
+	errBinary      = errors.New("binary data in line")
+)
+
+// sniffLines is the number of lines read at the start of a file to guess its format
+const sniffLines = 200
+
+/*
+lineParsers is the registry of the known formats. Parsers can keep some state (the csv
+header for example) so the registry holds constructors and each file gets new parsers.
+The order of parserOrder is the order of preference when two parsers do as well.
+fallbackParsers are the ones that accept nearly any line, see sniffParser.
+*/
+var (
+	lineParsers = map[string]func() LineParser{
+		"email:pass":     func() LineParser { return &sepParser{name: "email:pass", sep: ":", needEmail: true} },
+		"email;pass":     func() LineParser { return &sepParser{name: "email;pass", sep: ";", needEmail: true} },
+		"user:pass":      func() LineParser { return &sepParser{name: "user:pass", sep: ":"} },
+		"tsv":            func() LineParser { return &sepParser{name: "tsv", sep: "\t"} },
+		"csv":            func() LineParser { return &csvParser{} },
+		"url:email:pass": func() LineParser { return &stealerParser{} },
+	}
+	parserOrder     = []string{"email:pass", "email;pass", "url:email:pass", "csv", "tsv", "user:pass"}
+	fallbackParsers = map[string]bool{"user:pass": true}
+)
+
+// newParser returns a new parser from the registry
+func newParser(name string) (LineParser, error) {
+	newP, ok := lineParsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown line format %q, known formats are: %s", name, strings.Join(parserNames(), ", "))
+	}
+	return newP(), nil
+}
+
+func parserNames() []string {
+	var names []string
+	for n := range lineParsers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+sniffParser tries every parser on the sample and keeps the one that reads the most
+lines. The lenient parsers of fallbackParsers read about anything, so they are only
+kept when none of the others reads at least half of the sample. If nothing reads
+anything, email:pass is used.
+*/
+func sniffParser(sample []string) LineParser {
+	best, bestScore := "", 0
+	strict, strictScore := "", 0
+
+	for _, name := range parserOrder {
+		p := lineParsers[name]()
+		score := 0
+		for _, line := range sample {
+			_, err := p.Parse(line)
+			if err == nil {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = name, score
+		}
+		if !fallbackParsers[name] && score > strictScore {
+			strict, strictScore = name, score
+		}
+	}
+
+	switch {
+	case strict != "" && strictScore*2 >= len(sample):
+		best = strict
+	case best == "":
+		best = parserOrder[0]
+	}
+	// the sniffing went through the lines, the file starts again with a clean parser
+	p, _ := newParser(best)
+	return p
+}
+
+/*
+parserFor picks the parser of a job. The overrides of -formats are checked first,
+matched on the file name (or member name for archives) and on the path relative to
+the parent directory, then -format, and if it is "auto" the sample is sniffed.
+*/
+func parserFor(job dirStruct, sample []string) (LineParser, error) {
+	base := job.file
+	rel := path.Join(job.name, job.file)
+	if job.member != "" {
+		base = path.Base(job.member)
+		rel = path.Join(rel, job.member)
+	}
+
+	for _, o := range splitPatterns(*FormatOverrides) {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad format override %q, expecting pattern=format", o)
+		}
+		if matchAny([]string{kv[0]}, base, rel) {
+			return newParser(kv[1])
+		}
+	}
+
+	if *Format != "auto" {
+		return newParser(*Format)
+	}
+
+	return sniffParser(sample), nil
+}
+
+// checkFormats makes sure the formats given on the command line exist before starting
+func checkFormats() error {
+	if *SplitOn != "first" && *SplitOn != "last" {
+		return fmt.Errorf("bad split %q, expecting first or last", *SplitOn)
+	}
+	if *Format != "auto" {
+		if _, err := newParser(*Format); err != nil {
+			return err
+		}
+	}
+	for _, o := range splitPatterns(*FormatOverrides) {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad format override %q, expecting pattern=format", o)
+		}
+		if _, err := newParser(kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+cleanLine gets rid of what is not part of the credential: the utf-8 BOM at the start
+of a file, the '\r' of windows line endings and the NUL bytes some dumps are padded
+with. A line that still has NUL bytes in it is binary data and returns errBinary.
+*/
+func cleanLine(line string) (string, error) {
+	line = strings.TrimPrefix(line, "\uFEFF")
+	line = strings.TrimSuffix(line, "\r")
+	line = strings.Trim(line, "\x00")
+	if strings.IndexByte(line, 0) >= 0 {
+		return "", errBinary
+	}
+	return line, nil
+}
+
+/*
+splitEmail cuts an email in username and domain, it returns errBadEmail if it does not
+look like one: one '@', no spaces, and a domain with a dot that is not at either end.
+*/
+func splitEmail(email string) (username, domain string, err error) {
+	split := strings.Split(email, "@")
+	if len(split) != 2 || split[0] == "" || strings.ContainsAny(email, " \t") {
+		return "", "", errBadEmail
+	}
+	domain = split[1]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", "", errBadEmail
+	}
+	return split[0], domain, nil
+}
+
+/*
+splitLine finds where the login stops and the password starts. Passwords often have
+the separator in them, so by default (-split first) we cut at the first separator
+after the '@' of the email, or the first one at all if the login is not an email.
+With -split last we cut at the last separator, for when the logins have it instead.
+*/
+func splitLine(line, sep string, email bool) (login, password string, err error) {
+	if !strings.Contains(line, sep) {
+		return "", "", errNoSeparator
+	}
+	var idx int
+	switch {
+	case *SplitOn == "last":
+		idx = strings.LastIndex(line, sep)
+	case email:
+		at := strings.IndexByte(line, '@')
+		if at < 0 {
+			return "", "", errBadEmail
+		}
+		idx = strings.Index(line[at:], sep)
+		if idx >= 0 {
+			idx += at
+		}
+	default:
+		idx = strings.Index(line, sep)
+	}
+	if idx < 0 {
+		return "", "", errNoSeparator
+	}
+	return strings.TrimSpace(line[:idx]), line[idx+len(sep):], nil
+}
+
+// sepParser reads "login<sep>password" lines, the login has to be an email if needEmail is set
+type sepParser struct {
+	name      string
+	sep       string
+	needEmail bool
+}
+
+func (p *sepParser) Name() string { return p.name }
+
+func (p *sepParser) Parse(line string) (credential, error) {
+	login, password, err := splitLine(line, p.sep, p.needEmail)
+	if err != nil {
+		return credential{}, err
+	}
+
+	c := credential{Email: login, Username: login, Password: password}
+	username, domain, err := splitEmail(c.Email)
+	if err == nil && strings.Contains(login, p.sep) {
+		err = errBadEmail // the '@' we split after was in the password
+	}
+	switch {
+	case err == nil:
+		c.Username = username
+		c.Domain = domain
+	case p.needEmail:
+		return credential{}, err
+	case c.Email == "":
+		return credential{}, errBadFields
+	}
+
+	return c, nil
+}
+
+/*
+csvParser reads csv files with a header. The first line that has a login and a password
+column is taken as the header, the columns are then looked for at the same place.
+*/
+type csvParser struct {
+	login    int
+	password int
+	url      int
+	fields   int
+	header   bool
+}
+
+func (p *csvParser) Name() string { return "csv" }
+
+func (p *csvParser) Parse(line string) (credential, error) {
+	r := csv.NewReader(strings.NewReader(line))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	fields, err := r.Read()
+	if err != nil || len(fields) < 2 {
+		return credential{}, errNoSeparator
+	}
+
+	if !p.header {
+		p.login, p.password, p.url = -1, -1, -1
+		for i, f := range fields {
+			switch strings.ToLower(strings.TrimSpace(f)) {
+			case "email", "e-mail", "mail", "email_address", "login", "username", "user", "user_name":
+				if p.login < 0 {
+					p.login = i
+				}
+			case "password", "pass", "passwd", "pwd":
+				p.password = i
+			case "url", "site", "website", "host":
+				p.url = i
+			}
+		}
+		if p.login < 0 || p.password < 0 {
+			return credential{}, errNoHeader
+		}
+		p.header = true
+		p.fields = len(fields)
+		return credential{}, errHeader
+	}
+
+	if len(fields) != p.fields {
+		return credential{}, errBadFields
+	}
+
+	c := credential{Email: fields[p.login], Username: fields[p.login], Password: fields[p.password]}
+	if p.url >= 0 {
+		c.URL = fields[p.url]
+	}
+	if username, domain, err := splitEmail(c.Email); err == nil {
+		c.Username = username
+		c.Domain = domain
+	}
+	if c.Email == "" {
+		return credential{}, errBadFields
+	}
+
+	return c, nil
+}
+
+/*
+stealerParser reads the "url:login:pass" lines found in stealer logs. The url has ':'
+in it (scheme, port) so we look for the first field after the url that is an email. If
+there is none, the last two fields are the login and the password.
+*/
+type stealerParser struct{}
+
+func (p *stealerParser) Name() string { return "url:email:pass" }
+
+func (p *stealerParser) Parse(line string) (credential, error) {
+	scheme := strings.Index(line, "://")
+	if scheme <= 0 {
+		return credential{}, errBadFields
+	}
+
+	fields := strings.Split(line, ":")
+	if len(fields) < 4 { // scheme, //host, login, password
+		return credential{}, errNoSeparator
+	}
+
+	for i := 2; i < len(fields)-1; i++ {
+		username, domain, err := splitEmail(fields[i])
+		if err != nil {
+			continue
+		}
+		return credential{
+			URL:      strings.Join(fields[:i], ":"),
+			Email:    fields[i],
+			Username: username,
+			Domain:   domain,
+			Password: strings.Join(fields[i+1:], ":"),
+		}, nil
+	}
+
+	n := len(fields)
+	if fields[n-2] == "" {
+		return credential{}, errBadFields
+	}
+	return credential{
+		URL:      strings.Join(fields[:n-2], ":"),
+		Email:    fields[n-2],
+		Username: fields[n-2],
+		Password: fields[n-1],
+	}, nil
+}
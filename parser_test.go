@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test -run TestParserGolden -update rewrites the .golden files from what the parsers do now
+var update = flag.Bool("update", false, "rewrite the .golden files of testdata")
+
+func TestCleanLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+		err  error
+	}{
+		{"plain", "a@b.com:pw", "a@b.com:pw", nil},
+		{"bom", "\uFEFFa@b.com:pw", "a@b.com:pw", nil},
+		{"bom only at the start", "a@b.com:\uFEFFpw", "a@b.com:\uFEFFpw", nil},
+		{"crlf", "a@b.com:pw\r", "a@b.com:pw", nil},
+		{"one cr only", "a@b.com:pw\r\r", "a@b.com:pw\r", nil},
+		{"nul padding", "\x00\x00a@b.com:pw\x00", "a@b.com:pw", nil},
+		{"nul inside", "a@b.com:p\x00w", "", errBinary},
+		{"only nul", "\x00\x00\x00", "", nil},
+		{"unicode", "josé@exämple.fr:☃", "josé@exämple.fr:☃", nil},
+		{"empty", "", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanLine(tt.line)
+			if got != tt.want || err != tt.err {
+				t.Errorf("cleanLine(%q) = %q, %v, want %q, %v", tt.line, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestSplitEmail(t *testing.T) {
+	tests := []struct {
+		email    string
+		username string
+		domain   string
+		err      error
+	}{
+		{"john@example.com", "john", "example.com", nil},
+		{"Marie.Curie@Example.COM", "Marie.Curie", "Example.COM", nil},
+		{"josé@exämple.fr", "josé", "exämple.fr", nil},
+		{"john@localhost", "", "", errBadEmail},
+		{"john@.com", "", "", errBadEmail},
+		{"john@example.", "", "", errBadEmail},
+		{"@example.com", "", "", errBadEmail},
+		{"a@b@example.com", "", "", errBadEmail},
+		{"jo hn@example.com", "", "", errBadEmail},
+		{"john", "", "", errBadEmail},
+	}
+	for _, tt := range tests {
+		username, domain, err := splitEmail(tt.email)
+		if username != tt.username || domain != tt.domain || err != tt.err {
+			t.Errorf("splitEmail(%q) = %q, %q, %v, want %q, %q, %v", tt.email, username, domain, err, tt.username, tt.domain, tt.err)
+		}
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		split    string
+		line     string
+		sep      string
+		email    bool
+		login    string
+		password string
+		err      error
+	}{
+		{"first", "a@b.com:pw", ":", true, "a@b.com", "pw", nil},
+		{"first", "a@b.com:p:w:", ":", true, "a@b.com", "p:w:", nil},
+		{"first", "a@b.com:", ":", true, "a@b.com", "", nil},
+		{"first", " a@b.com :pw", ":", true, "a@b.com", "pw", nil},
+		{"first", "a@b.com: pw ", ":", true, "a@b.com", " pw ", nil},
+		{"first", "user:p@ss", ":", true, "", "", errNoSeparator},
+		{"first", "nosep", ":", true, "", "", errNoSeparator},
+		{"first", "no-at:pw", ":", true, "", "", errBadEmail},
+		{"first", "user:p:w", ":", false, "user", "p:w", nil},
+		{"first", "a@b.com;p;w", ";", true, "a@b.com", "p;w", nil},
+		{"first", "a@b.com\tp\tw", "\t", false, "a@b.com", "p\tw", nil},
+		{"last", "us:er:pw", ":", false, "us:er", "pw", nil},
+		{"last", "a@b.com:p:w", ":", true, "a@b.com:p", "w", nil},
+	}
+	for _, tt := range tests {
+		testConfig(t, "-split", tt.split)
+		login, password, err := splitLine(tt.line, tt.sep, tt.email)
+		if login != tt.login || password != tt.password || err != tt.err {
+			t.Errorf("-split %s splitLine(%q, %q, %v) = %q, %q, %v, want %q, %q, %v",
+				tt.split, tt.line, tt.sep, tt.email, login, password, err, tt.login, tt.password, tt.err)
+		}
+	}
+}
+
+/*
+TestParserGolden reads every file of testdata/lines the way a worker does (line scanner,
+cleanLine, parser) and compares what became of each line with the .golden file next to
+it. The parser is the format in the name of the file, with '-' for ':'.
+*/
+func TestParserGolden(t *testing.T) {
+	testConfig(t)
+	files, err := filepath.Glob(filepath.Join("testdata", "lines", "*.txt"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test files in testdata/lines: %v", err)
+	}
+
+	for _, path := range files {
+		name := strings.TrimSuffix(filepath.Base(path), ".txt")
+		t.Run(name, func(t *testing.T) {
+			parser, err := newParser(strings.ReplaceAll(name, "-", ":"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			var got bytes.Buffer
+			scanner := newLineScanner(file, 0)
+			for n := 1; scanner.Scan(); n++ {
+				fmt.Fprintf(&got, "%d %d %q -> %s\n", n, scanner.offset, scanner.Text(), parseResult(parser, scanner.Text()))
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := strings.TrimSuffix(path, ".txt") + ".golden"
+			if *update {
+				err = ioutil.WriteFile(golden, got.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, run with -update to make it", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s does not match %s:\n%s", path, golden, diffLines(string(want), got.String()))
+			}
+		})
+	}
+}
+
+// parseResult is what a worker does with raw: the credential it gets out of it, or why it was skipped
+func parseResult(parser LineParser, raw string) string {
+	line, err := cleanLine(raw)
+	if err != nil {
+		return "reject: " + err.Error()
+	}
+	if line == "" {
+		return "skip: empty"
+	}
+	c, err := parser.Parse(line)
+	if err == errHeader {
+		return "skip: " + err.Error()
+	}
+	if err != nil {
+		return "reject: " + err.Error()
+	}
+	return fmt.Sprintf("email=%q username=%q domain=%q password=%q url=%q", c.Email, c.Username, c.Domain, c.Password, c.URL)
+}
+
+// diffLines returns the lines of got that are not the same as in want
+func diffLines(want, got string) string {
+	w := strings.Split(want, "\n")
+	g := strings.Split(got, "\n")
+	var diff strings.Builder
+	for i := 0; i < len(w) || i < len(g); i++ {
+		var wl, gl string
+		if i < len(w) {
+			wl = w[i]
+		}
+		if i < len(g) {
+			gl = g[i]
+		}
+		if wl != gl {
+			fmt.Fprintf(&diff, "- %s\n+ %s\n", wl, gl)
+		}
+	}
+	return diff.String()
+}
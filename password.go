@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+/*
+The password storage policy (-passwords) is what goes in passwords.password. The database
+is a secret as long as it holds the passwords in clear, so it can keep only a digest or
+a masked preview instead:
+
+	plaintext  the password as it was in the leak
+	sha1       SHA-1 of the password, uppercase hex, as in the HIBP password lists
+	ntlm       NTLM hash (MD4 of the UTF-16LE password), uppercase hex
+	sha256     SHA-256 of the password, uppercase hex
+	hmac       HMAC-SHA256 of the password with the hash key (-hashkey), uppercase hex
+	mask       first and last character of the password, '*' in between
+
+The hashID of a password is computed from the password of the leak, before the policy
+(see credHasher.PasswordID): two passwords with the same mask or digest prefix are still
+two rows, the policy only changes what the row holds. The policy is stored in the metadata table when the database gets its first creds and cannot
+change after that, so search and export know what they are reading.
+*/
+
+const passwordPlaintext = "plaintext"
+
+// passwordPolicies are the -passwords policies, each returns a new storer (they are not safe for concurrent use)
+var passwordPolicies = map[string]func() passwordStorer{
+	passwordPlaintext: func() passwordStorer { return plainStorer{} },
+	"sha1":            func() passwordStorer { return &digestStorer{h: sha1.New()} },
+	"ntlm":            func() passwordStorer { return &digestStorer{h: md4.New(), utf16: true} },
+	"sha256":          func() passwordStorer { return &digestStorer{h: sha256.New()} },
+	"hmac":            func() passwordStorer { return &digestStorer{h: hmac.New(sha256.New, hashKey)} },
+	"mask":            func() passwordStorer { return maskStorer{} },
+}
+
+// passwordStorer turns the password of a leak into what is stored in passwords.password
+type passwordStorer interface {
+	Store(password string) string
+}
+
+type plainStorer struct{}
+
+func (plainStorer) Store(password string) string { return password }
+
+type maskStorer struct{}
+
+func (maskStorer) Store(password string) string { return maskPassword(password) }
+
+type digestStorer struct {
+	h     hash.Hash
+	utf16 bool // hash the UTF-16LE encoding of the password, for NTLM
+	buf   []byte
+}
+
+func (d *digestStorer) Store(password string) string {
+	d.h.Reset()
+	if d.utf16 {
+		d.buf = d.buf[:0]
+		for _, u := range utf16.Encode([]rune(password)) {
+			d.buf = append(d.buf, byte(u), byte(u>>8))
+		}
+		d.h.Write(d.buf)
+	} else {
+		d.h.Write([]byte(password))
+	}
+	return strings.ToUpper(hex.EncodeToString(d.h.Sum(nil)))
+}
+
+// newPasswordStorer returns the storer of the -passwords policy
+func newPasswordStorer() passwordStorer {
+	return passwordPolicies[*PasswordPolicy]()
+}
+
+/*
+checkPasswordPolicy makes sure -passwords is a known policy. Every policy but plaintext
+needs the hash key: the hashID of a password is computed from the password of the leak,
+unkeyed it would tell what a digest or a mask hides to anyone trying a list of passwords.
+*/
+func checkPasswordPolicy() error {
+	if _, ok := passwordPolicies[*PasswordPolicy]; !ok {
+		return fmt.Errorf("unknown password policy %q, expecting plaintext, sha1, ntlm, sha256, hmac or mask", *PasswordPolicy)
+	}
+	if *PasswordPolicy != passwordPlaintext && len(hashKey) == 0 {
+		return fmt.Errorf("the %s password policy needs a hash key (-hashkey or TR4IL_HASH_KEY)", *PasswordPolicy)
+	}
+	return nil
+}
+
+/*
+storedPasswordPolicy returns the policy of the passwords of the database. Databases
+made before the policies existed have no policy stored, their passwords are in clear.
+*/
+func storedPasswordPolicy(db execer) (string, error) {
+	policy, err := getMetadata(db, "password_policy")
+	if err == sql.ErrNoRows {
+		return passwordPlaintext, nil
+	}
+	return policy, err
+}
+
+/*
+setPasswordPolicy stores -passwords in the metadata of a database without creds. A
+database that already has creds keeps its policy, -passwords has to match it: mixing
+digests and passwords in the same column would make it unreadable.
+*/
+func setPasswordPolicy(db execer) error {
+	has, err := hasCreds(db)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return setMetadata(db, "password_policy", *PasswordPolicy)
+	}
+
+	policy, err := storedPasswordPolicy(db)
+	if err != nil {
+		return err
+	}
+	if policy != *PasswordPolicy {
+		return fmt.Errorf("the passwords of %s are stored as %s, cannot add creds with -passwords %s", *DBName, policy, *PasswordPolicy)
+	}
+	return setMetadata(db, "password_policy", policy)
+}
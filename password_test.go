@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the passwords are deduped on the passwords of the leak, not on what the policy stores
+func TestPasswordIDBeforePolicy(t *testing.T) {
+	saved := hashKey
+	hashKey = []byte("test key")
+	defer func() { hashKey = saved }()
+
+	for policy := range passwordPolicies {
+		t.Run(policy, func(t *testing.T) {
+			root := t.TempDir()
+			testConfig(t, "-u", root, "-p", "leaks", "-passwords", policy)
+			store := testStore(t)
+			dir := filepath.Join(root, "leaks", "masks")
+			err := os.MkdirAll(dir, 0750)
+			if err == nil {
+				// same mask, same first and last characters
+				err = ioutil.WriteFile(filepath.Join(dir, "dump.txt"), []byte("a@x.com:hunter2\nb@x.com:harbor2\nc@x.com:hunter2\nd@x.com:**\n"), 0600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			testIngest(t, context.Background(), store)
+
+			if n := testCount(t, store, "passwords"); n != 3 {
+				t.Errorf("%v passwords, want 3 (hunter2, harbor2 and **)", n)
+			}
+			if n := testCount(t, store, "sightings"); n != 4 {
+				t.Errorf("%v sightings, want 4", n)
+			}
+			var hunter2 string
+			err = store.Meta().QueryRow("SELECT p.password FROM passwords p JOIN sightings s ON s.password = p.id JOIN identities i ON i.id = s.identity WHERE i.local = 'c'").Scan(&hunter2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := passwordPolicies[policy]().Store("hunter2"); hunter2 != want {
+				t.Errorf("hunter2 is stored as %q, want %q", hunter2, want)
+			}
+		})
+	}
+}
+
+// every policy but plaintext needs the hash key, the hashID of the password would give it away
+func TestCheckPasswordPolicy(t *testing.T) {
+	saved := hashKey
+	defer func() { hashKey = saved }()
+
+	for policy := range passwordPolicies {
+		testConfig(t, "-passwords", policy)
+		hashKey = nil
+		err := checkPasswordPolicy()
+		if policy == passwordPlaintext && err != nil {
+			t.Errorf("plaintext without a hash key: %s", err)
+		}
+		if policy != passwordPlaintext && err == nil {
+			t.Errorf("%s accepted without a hash key", policy)
+		}
+		hashKey = []byte("test key")
+		err = checkPasswordPolicy()
+		if err != nil {
+			t.Errorf("%s with a hash key: %s", policy, err)
+		}
+	}
+
+	testConfig(t, "-passwords", "md5")
+	if err := checkPasswordPolicy(); err == nil {
+		t.Error("unknown policy md5 accepted")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/*
+The PostgreSQL store, for the volumes SQLite does not keep up with: "-d
+postgres://user@host/tr4il". The password is better in PGPASSWORD or ~/.pgpass than in
+the URL, -d ends up in the logs.
+
+It has the tables of the SQLite schema at its last version (without the views of the old
+tables), made by its own migrations. The creds of a batch are sent with COPY to a
+temporary table, and go from there to identities, passwords and sightings with one
+INSERT ... SELECT each: a batch is a handful of statements instead of a few per cred.
+
+The queries shared with SQLite (metadata, search) are written with ? placeholders, pgDB
+turns them into $1, $2...
+*/
+
+var pgMigrations = []migration{
+	{version: 1, name: "initial schema",
+		steps: []string{
+			`CREATE TABLE leaks (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		parent TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		member TEXT NOT NULL DEFAULT '',
+		hashID TEXT NOT NULL UNIQUE,
+		date TEXT,
+		website TEXT,
+		linenumber INTEGER,
+		status INTEGER,
+		parsed INTEGER NOT NULL DEFAULT 0,
+		duplicates INTEGER NOT NULL DEFAULT 0,
+		rejected INTEGER NOT NULL DEFAULT 0,
+		byteoffset BIGINT NOT NULL DEFAULT 0,
+		lineoffset INTEGER NOT NULL DEFAULT 0
+	  )`,
+			`CREATE TABLE rejects (
+		id BIGSERIAL PRIMARY KEY,
+		leak BIGINT NOT NULL REFERENCES leaks(id),
+		line INTEGER,
+		reason TEXT NOT NULL,
+		content TEXT,
+		UNIQUE(leak, line)
+	  )`,
+			`CREATE TABLE metadata (
+		key TEXT NOT NULL PRIMARY KEY,
+		value TEXT
+	  )`,
+			`CREATE TABLE domains (
+		id BIGSERIAL PRIMARY KEY,
+		domain TEXT NOT NULL UNIQUE
+	  )`,
+			`CREATE TABLE identities (
+		id BIGSERIAL PRIMARY KEY,
+		hashID TEXT NOT NULL UNIQUE,
+		local TEXT NOT NULL,
+		domain_id BIGINT REFERENCES domains(id)
+	  )`,
+			"CREATE INDEX identities_domain ON identities(domain_id)",
+			`CREATE TABLE passwords (
+		id BIGSERIAL PRIMARY KEY,
+		hashID TEXT NOT NULL UNIQUE,
+		password TEXT
+	  )`,
+			`CREATE TABLE sightings (
+		id BIGSERIAL PRIMARY KEY,
+		identity BIGINT NOT NULL REFERENCES identities(id),
+		password BIGINT NOT NULL REFERENCES passwords(id),
+		leak BIGINT NOT NULL REFERENCES leaks(id),
+		line INTEGER,
+		url TEXT,
+		firstSeen TEXT,
+		UNIQUE(identity, password, leak)
+	  )`,
+			"CREATE INDEX sightings_leak ON sightings(leak)",
+		}},
+
+	{version: 2, name: "failed leaks",
+		steps: []string{
+			"ALTER TABLE leaks ADD COLUMN error TEXT",
+			"ALTER TABLE leaks ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0",
+		}},
+
+	{version: 3, name: "lowercase domains",
+		steps: []string{
+			`UPDATE identities SET domain_id = (SELECT min(k.id) FROM domains k JOIN domains d ON lower(k.domain) = lower(d.domain)
+			WHERE d.id = identities.domain_id)
+			WHERE domain_id NOT IN (SELECT min(id) FROM domains GROUP BY lower(domain))`,
+			"DELETE FROM domains WHERE id NOT IN (SELECT min(id) FROM domains GROUP BY lower(domain))",
+			"UPDATE domains SET domain = lower(domain) WHERE domain <> lower(domain)",
+		}},
+}
+
+// pgSearch is the search query of PostgreSQL, which wants the keys of the tables in the GROUP BY
+var pgSearch = searchDialect{
+	groupBy: "i.id, p.id, d.id",
+	leaks:   "string_agg(s.leak::text, ',')",
+}
+
+// pgDB runs the queries written for SQLite, with ? placeholders, on PostgreSQL
+type pgDB struct {
+	*sql.DB
+}
+
+func (db pgDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(rebind(query), args...)
+}
+
+func (db pgDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(rebind(query), args...)
+}
+
+func (db pgDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(rebind(query), args...)
+}
+
+// rebind replaces the ? placeholders of query by $1, $2... leaving the string literals alone
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+type pgStore struct {
+	db *sql.DB
+}
+
+func openPGStore(dsn string) (*pgStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to PostgreSQL: %s", err)
+	}
+	return &pgStore{db: db}, nil
+}
+
+func (s *pgStore) Meta() querier     { return pgDB{s.db} }
+func (s *pgStore) FinishLoad() error { return nil }
+func (s *pgStore) Close() error      { return s.db.Close() }
+
+// Migrate applies the pgMigrations the database does not have, each in its own transaction
+func (s *pgStore) Migrate() (applied int, err error) {
+	_, err = s.db.Exec(createSchemaVersionSQL)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = s.db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	last := pgMigrations[len(pgMigrations)-1].version
+	if version > last {
+		return 0, fmt.Errorf("the database has schema version %v, this tr4ilGo only knows up to %v", version, last)
+	}
+
+	for _, m := range pgMigrations {
+		if m.version <= version {
+			continue
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		for _, step := range m.steps {
+			_, err = tx.Exec(step)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version(version, name, applied) VALUES ($1, $2, $3)", m.version, m.name, time.Now().Format(firstSeenLayout))
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			return applied, fmt.Errorf("migration %v (%s): %s", m.version, m.name, err)
+		}
+		applied++
+		Logg(fmt.Sprintf("PostgreSQL database migrated to version %v (%s)", m.version, m.name), "Info")
+	}
+	return applied, nil
+}
+
+func (s *pgStore) LeakID(hashID string) (id int, err error) {
+	err = s.db.QueryRow("SELECT id FROM leaks WHERE hashID = $1", hashID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no rows where found for %v", hashID)
+	}
+	return id, err
+}
+
+func (s *pgStore) AddLeak(l leakRows) (id int, err error) {
+	err = s.db.QueryRow(`INSERT INTO leaks(name, parent, filename, member, hashID, date, website, linenumber, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		l.Name, l.Parent, l.FileName, l.Member, l.HashID, l.Date, l.Website, l.LineNumber, l.Status).Scan(&id)
+	return id, err
+}
+
+func (s *pgStore) ArchiveMembers(parent, name, file string) ([]archiveMember, error) {
+	return readArchiveMembers(pgDB{s.db}, parent, name, file)
+}
+
+func (s *pgStore) LeakStatus(id int) (status int, err error) {
+	err = s.db.QueryRow("SELECT status FROM leaks WHERE id = $1", id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return -1, fmt.Errorf("no rows where found for %v", id)
+	}
+	return status, err
+}
+
+func (s *pgStore) SetLeakStatus(id, status int) error {
+	_, err := s.db.Exec("UPDATE leaks SET status = $1 WHERE id = $2", status, id)
+	return err
+}
+
+func (s *pgStore) ReadCheckpoint(id int) (c checkpoint, err error) {
+	err = s.db.QueryRow("SELECT byteoffset, lineoffset, parsed, duplicates, rejected FROM leaks WHERE id = $1", id).Scan(
+		&c.offset, &c.line, &c.counts.parsed, &c.counts.duplicates, &c.counts.rejected)
+	return c, err
+}
+
+func (s *pgStore) Search(q CredQuery, fn func(CredResult) error) error {
+	return searchCreds(pgDB{s.db}, pgSearch, q, fn)
+}
+
+type pgTx struct {
+	tx     *sql.Tx
+	staged bool // the staged table was made in this transaction
+}
+
+func (s *pgStore) Begin() (StoreTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &pgTx{tx: tx}, nil
+}
+
+func (t *pgTx) Commit() error   { return t.tx.Commit() }
+func (t *pgTx) Rollback() error { return t.tx.Rollback() }
+
+// stagedColumns are the columns of the staged table filled by COPY, n keeps the order of the batch
+// (pq.CopyIn quotes them, they have to be lowercase like the ones PostgreSQL made)
+var stagedColumns = []string{"n", "identity_hash", "local", "domain", "password_hash", "password", "leak", "line", "url", "firstseen"}
+
+/*
+pgBatchSQL moves the staged creds to their tables. A cred is known when its identity
+already had a sighting with its password, or when it comes again in the batch: the same
+as SQLite counts it, one cred at a time.
+*/
+var pgBatchSQL = []string{
+	"INSERT INTO domains(domain) SELECT DISTINCT domain FROM staged WHERE domain <> '' ON CONFLICT DO NOTHING",
+	`INSERT INTO identities(hashID, local, domain_id)
+		SELECT DISTINCT ON (s.identity_hash) s.identity_hash, s.local, d.id FROM staged s LEFT JOIN domains d ON d.domain = s.domain
+		ORDER BY s.identity_hash, s.n ON CONFLICT DO NOTHING`,
+	`INSERT INTO passwords(hashID, password)
+		SELECT DISTINCT ON (password_hash) password_hash, password FROM staged ORDER BY password_hash, n ON CONFLICT DO NOTHING`,
+	"UPDATE staged s SET identity_id = i.id FROM identities i WHERE i.hashID = s.identity_hash",
+	"UPDATE staged s SET password_id = p.id FROM passwords p WHERE p.hashID = s.password_hash",
+}
+
+const pgKnownSQL = `SELECT leak, count(*) FROM (
+		SELECT s.leak, row_number() OVER (PARTITION BY s.identity_id, s.password_id ORDER BY s.n) AS k,
+		EXISTS (SELECT 1 FROM sightings f WHERE f.identity = s.identity_id AND f.password = s.password_id) AS known
+		FROM staged s) c
+	WHERE known OR k > 1 GROUP BY leak`
+
+const pgSightingsSQL = `INSERT INTO sightings(identity, password, leak, line, url, firstSeen)
+	SELECT identity_id, password_id, leak, line, url, firstSeen FROM staged ORDER BY n ON CONFLICT DO NOTHING`
+
+func (t *pgTx) WriteCreds(creds []record) (duplicates map[int]int, err error) {
+	if !t.staged {
+		_, err = t.tx.Exec(`CREATE TEMPORARY TABLE staged (
+			n INTEGER, identity_hash TEXT, local TEXT, domain TEXT, password_hash TEXT, password TEXT,
+			leak BIGINT, line INTEGER, url TEXT, firstSeen TEXT,
+			identity_id BIGINT, password_id BIGINT
+		  ) ON COMMIT DROP`)
+		if err != nil {
+			return nil, err
+		}
+		t.staged = true
+	}
+
+	copyIn, err := t.tx.Prepare(pq.CopyIn("staged", stagedColumns...))
+	if err != nil {
+		return nil, err
+	}
+	for n, r := range creds {
+		s := r.sighting
+		_, err = copyIn.Exec(n, r.identity.HashID, r.identity.Local, r.domain, r.password.HashID, r.password.Password,
+			s.Leak, s.Line, s.URL, s.FirstSeen)
+		if err != nil {
+			copyIn.Close()
+			return nil, err
+		}
+	}
+	_, err = copyIn.Exec()
+	if err == nil {
+		err = copyIn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range pgBatchSQL {
+		_, err = t.tx.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	duplicates = map[int]int{}
+	rows, err := t.tx.Query(pgKnownSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var leak, n int
+		err = rows.Scan(&leak, &n)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		duplicates[leak] = n
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = t.tx.Exec(pgSightingsSQL)
+	if err == nil {
+		_, err = t.tx.Exec("TRUNCATE staged")
+	}
+	return duplicates, err
+}
+
+func (t *pgTx) WriteRejects(rejects []rejectRows) error {
+	for _, r := range rejects {
+		_, err := t.tx.Exec("INSERT INTO rejects(leak, line, reason, content) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			r.Leak, r.Line, r.Reason, r.Content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *pgTx) SetLeakStatus(id, status int) error {
+	_, err := t.tx.Exec("UPDATE leaks SET status = $1 WHERE id = $2", status, id)
+	return err
+}
+
+func (t *pgTx) SaveCounts(id int, counts leakCounts) error {
+	_, err := t.tx.Exec("UPDATE leaks SET parsed = $1, duplicates = $2, rejected = $3 WHERE id = $4",
+		counts.parsed, counts.duplicates, counts.rejected, id)
+	return err
+}
+
+func (t *pgTx) SaveFailure(id, attempts int, failure string) error {
+	_, err := t.tx.Exec("UPDATE leaks SET status = 4, error = $1, attempts = attempts + $2 WHERE id = $3", failure, attempts, id)
+	return err
+}
+
+func (t *pgTx) SaveCheckpoint(id int, c checkpoint) error {
+	_, err := t.tx.Exec("UPDATE leaks SET byteoffset = $1, lineoffset = $2, parsed = $3, duplicates = $4, rejected = $5 WHERE id = $6",
+		c.offset, c.line, c.counts.parsed, c.counts.duplicates, c.counts.rejected, id)
+	return err
+}
@@ -4,195 +4,186 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"sync"
-	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/vbauerster/mpb"
 	"github.com/vbauerster/mpb/decor"
+	"golang.org/x/sync/errgroup"
 )
 
+// jobData is what the producer keeps while the job runs, it is only touched by startProducer
 type jobData struct {
-	WorkQueue      chan workRequest
-	Result         chan workOutput
-	paramPointer   *JobParam
-	unscrapedFiles chan string
-	unscrapedLen   int
-	//fileSent       []string
-	fileSentLen  int
-	fileRecv     []string
-	fileRecvLen  int
-	continueProd bool
-	err          error
+	paramPointer *JobParam
+	writer       *writer
+	summary      jobSummary
+	outcome      map[int]string // leak id -> done, stopped or failed, as counted in summary
 }
+
+// jobSummary is what happened to the leaks of the job, the ones not counted were not started
+type jobSummary struct {
+	done    int // read to the end
+	stopped int // interrupted in the middle, resumed from their checkpoint next time
+	failed  int // could not be read after -retries tries, see ingest -retry-failed
+}
+
 type dirStruct struct {
 	name   string //Name folder in collection
 	parent string //Name fo collection
 	path   string // path to name
 	file   string // name file in name folder
+	member string // path of the file inside the archive, empty if file is not an archive
+	lines  int    // number of lines when known at discovery, -1 otherwise
 	leakID int
+
+	checkpoint checkpoint // where to resume a leak that was started
 }
 
 type workRequest struct {
 	Line string
 	Job  dirStruct
 	DB   *sql.DB
-	WG   *sync.WaitGroup
 }
 
 type workOutput struct {
-	Work  workRequest
-	Error error
+	Work     workRequest
+	Counts   leakCounts
+	Attempts int // times the leak was read, more than one when it failed
+	Error    error
 }
 
 /*
-Core function producerm it creats the context, and sends the jobs to workers.
-It checks what urls were visited, and creats a struct to keep all the data in one place.
-The context is sent to the workers in order to stop them when the work is done.
-param:
-	- fv pointer
-	- return output in JsonOutput and error
+Core function producer, it starts the writer and a pool of -w workers and feeds them the
+leaks of the job. They run in an errgroup: the feeder closes the jobs channel once every
+leak was sent (or the context is cancelled), the workers return when it is empty, and the
+results channel is closed when they all returned, so the result loop ends when the last
+result was handled. Only this goroutine touches jobData.
+
+When the context is cancelled (SIGINT, see interruptContext) no new leak is started, the
+workers stop after the line they are on and what they sent is committed by the writer
+along with the checkpoints, so the leaks in the middle stay at status 2 and are resumed by
+the next ingest.
 */
-func startProducer(param *JobParam) {
+func startProducer(ctx context.Context, param *JobParam) jobSummary {
 
-	//Declare context for current job
-	ctx := context.Background() //, cancel = context.WithTimeout(context.Background(), time.Second*time.Duration(20000))
-	// local struct contaning all the data. only pointers are sent across
 	s := jobData{
-		WorkQueue: make(chan workRequest, 1000),
-		Result:    make(chan workOutput, 1000),
-
 		paramPointer: param,
-
-		unscrapedFiles: make(chan string),
-		unscrapedLen:   1,
-		fileSentLen:    0,
-		fileRecvLen:    0,
-		continueProd:   true,
-		err:            nil,
+		writer:       startWriter(param.Store, param.Sink, 10000),
+		outcome:      map[int]string{},
 	}
 
-	var wg sync.WaitGroup //Local wait group to wait for the main loop that is sent as a go routing
-
-	startDispatcher(ctx, *NWorkers, &s) //Calling the dispatcher function that will start the workers and distribute the work
-	Logg("Sending initial job ", "Debug")
-	// start := time.Now() //get time as start to give a few seconds wait before timing out if nothing is received from workers
-
-	sendWork(ctx, s.paramPointer.JobList, &s) // starting a goroutiing of the sendWork
-	wg.Add(1)
-
-	//main loop as gorouting to listen and clean worker result and send new urls for scraping
-	go func(ctx context.Context, wg *sync.WaitGroup) {
-		p := mpb.New(mpb.WithWidth(64))
-
-		total := s.fileSentLen
-		name := "Single Bar:"
-		// adding a single bar, which will inherit container's width
-		bar := p.Add(int64(total),
-			// progress bar filler with customized style
-			mpb.NewBarFiller("╢▌▌░╟"),
-			mpb.PrependDecorators(
-				// display our name with one space on the right
-				decor.Name(name, decor.WC{W: len(name) + 1, C: decor.DidentRight}),
-				// replace ETA decorator with "done" message, OnComplete event
-				decor.OnComplete(
-					decor.AverageETA(decor.ET_STYLE_GO, decor.WC{W: 4}), "done",
-				),
+	jobs := make(chan workRequest)
+	results := make(chan workOutput, *NWorkers)
+
+	sampling, stopSampling := context.WithCancel(ctx)
+	defer stopSampling()
+	go sampleQueues(sampling, results, s.writer.records)
+
+	var g errgroup.Group
+	g.Go(func() error {
+		defer close(jobs)
+		return sendWork(ctx, param.JobList, jobs)
+	})
+	for i := 0; i < *NWorkers; i++ {
+		Logg(fmt.Sprintf("Starting worker %v/%v", i+1, *NWorkers), "Debug")
+		w := workerNew(ctx, i+1, s.writer.records)
+		g.Go(func() error { return w.Run(jobs, results) })
+	}
+	go func() {
+		// nothing returns an error, a leak that fails is reported in its result
+		g.Wait()
+		close(results)
+	}()
+
+	p := mpb.New(mpb.WithWidth(64))
+	name := "Single Bar:"
+	// adding a single bar, which will inherit container's width
+	bar := p.AddBar(int64(len(param.JobList)),
+		// progress bar with customized style
+		mpb.BarStyle("╢▌▌░╟"),
+		mpb.PrependDecorators(
+			// display our name with one space on the right
+			decor.Name(name, decor.WC{W: len(name) + 1, C: decor.DidentRight}),
+			// replace ETA decorator with "done" message, OnComplete event
+			decor.OnComplete(
+				decor.AverageETA(decor.ET_STYLE_GO, decor.WC{W: 4}), "done",
 			),
-			mpb.AppendDecorators(decor.Percentage()),
-		)
-		defer wg.Done()
-		for {
-
-			//switch condition to verify that we have not hit a wall
-			switch {
-			case s.fileRecvLen == s.fileSentLen:
-				// if we received the same number as we sent and that we waited a bit to make sure the workers are not working, we exit
-				return
-			default:
-				//If we havn't hit a stop condition, we go and listen for workers
-				select {
-				case <-ctx.Done(): // in case the context is canceled
-					return
-				case r := <-s.Result: // listening on result channel for workers' output
-					s.fileRecv = append(s.fileRecv, fmt.Sprint(r.Work)) //We add turl the worker scraped to our receive slice
-					s.fileRecvLen++                                     // and we increment the length
-					msg := fmt.Sprintf("Sent %v | Received %v ", s.fileSentLen, s.fileRecvLen)
-					// fmt.Printf("\r%s", msg) // lazy printing of progression on terminal
-					Logg(msg, "Info")
-					bar.Increment()
-					processResult(ctx, r, &s) // we send result to the process function
-
-				case <-time.After(2 * time.Second): // we loop every 2 seconds in order not to block on Result
-				}
-			}
-		}
-
-	}(ctx, &wg)
-	wg.Wait()
-	// cancel() //We cancel the context when the go loop returns
+		),
+		mpb.AppendDecorators(decor.Percentage()),
+	)
+
+	received := 0
+	for r := range results {
+		received++
+		LoggWith(log.Fields{"leak_id": r.Work.Job.leakID, "lines": r.Counts.parsed}, fmt.Sprintf("Sent %v | Received %v", len(param.JobList), received), "Info")
+		bar.Increment()
+		processResult(r, &s)
+	}
 
-	// TODO: check if necessary. Quick for loop to purge the work buffered queue
-	for len(s.WorkQueue) > 0 {
-		<-s.WorkQueue
+	// every worker returned, the writer can commit and stop
+	close(s.writer.records)
+	<-s.writer.done
+
+	// the leaks whose records the writer lost are failed, whatever their worker said
+	for leakID := range s.writer.failed {
+		switch s.outcome[leakID] {
+		case "failed":
+			continue
+		case "done":
+			s.summary.done--
+		case "stopped":
+			s.summary.stopped--
+		}
+		s.summary.failed++
 	}
 
+	return s.summary
 }
 
-/*
-Dispatcher function. It first creats a go routing for each worker and sends the appropriate
-data. In then sents an embedded go routine which listens for available workers.
-Once it gets one, it it grabs a work from the work queue and sends it to a worker
-*/
-func startDispatcher(ctx context.Context, n int, s *jobData) {
-
-	queue := make(chan chan workRequest, n)
-
-	for i := 0; i < n; i++ {
-		Logg(fmt.Sprintf("Starting worker %v/%v", i+1, n), "Debug")
-		worker := workerNew(ctx, i+1, s.paramPointer.DB, s.paramPointer.Mutex, queue, s.Result)
-		worker.Start()
-	}
-
-	go func(ctx context.Context, s *jobData) {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case work := <-s.WorkQueue:
-
-				go func(ctx context.Context) {
-					select {
-					case <-ctx.Done():
-						return
-					default:
-						worker := <-queue
-						worker <- work
-					}
-
-				}(ctx)
-
-			}
+// sendWork sends the jobs to the workers one at a time, it stops when ctx is cancelled
+func sendWork(ctx context.Context, list []dirStruct, jobs chan<- workRequest) error {
+	waiting := metricQueueDepth.WithLabelValues("work")
+	defer waiting.Set(0)
+	for i, j := range list {
+		waiting.Set(float64(len(list) - i))
+		if ctx.Err() != nil {
+			// select picks at random when both are ready
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case jobs <- workRequest{Job: j}:
 		}
-	}(ctx, s)
+	}
+	return nil
 }
 
-func sendWork(ctx context.Context, jobs []dirStruct, s *jobData) {
+// resultFields are the log fields of the result of a leak
+func resultFields(r workOutput) log.Fields {
+	fields := leakFields(r.Work.Job)
+	fields["lines"] = r.Counts.parsed
+	return fields
+}
 
-	sendToPugs := func(l dirStruct) {
-		s.unscrapedLen--
-		work := workRequest{Job: l}
-		s.WorkQueue <- work
+func processResult(r workOutput, s *jobData) {
+	if r.Error == errInterrupted {
+		// the leak stays at status 2, the writer saves its checkpoint when it commits
+		LoggWith(resultFields(r), "Leak stopped in the middle", "Info")
+		s.summary.stopped++
+		s.outcome[r.Work.Job.leakID] = "stopped"
+		return
 	}
-	for _, j := range jobs {
-
-		sendToPugs(j)
-		s.fileSentLen++
+	if r.Error != nil {
+		// the writer saves the error and sets the status to 4, the checkpoint is kept for -retry-failed
+		CheckErrWith(resultFields(r), r.Error, "Error", fmt.Sprintf("Leak failed after %v tries", r.Attempts))
+		s.summary.failed++
+		s.outcome[r.Work.Job.leakID] = "failed"
+		s.writer.records <- record{kind: recordFailed, leakID: r.Work.Job.leakID, counts: r.Counts, attempts: r.Attempts, failure: r.Error.Error()}
+		return
 	}
-
-}
-
-func processResult(ctx context.Context, r workOutput, s *jobData) {
-	err := ChangeStatus(s.paramPointer.DB, 3, r.Work.Job.leakID)
-	CheckErr(err, "Error", "Could not change status in DB")
+	s.summary.done++
+	s.outcome[r.Work.Job.leakID] = "done"
+	// the writer saves the counts and sets the status to 3 once the records before are written
+	s.writer.records <- record{kind: recordDone, leakID: r.Work.Job.leakID, counts: r.Counts}
 
 }
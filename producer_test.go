@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testJobs writes files dumps of lines lines under -u/-p and adds them to the store, as scanWorkingDir does
+func testJobs(t *testing.T, store Store, files, lines int) []dirStruct {
+	t.Helper()
+	for i := 0; i < files; i++ {
+		testDump(t, filepath.Join(*Path, *Parent, "jobs"), "dump"+strconv.Itoa(i)+".txt", lines)
+	}
+	if files == 0 {
+		return nil
+	}
+	found, err := discoverLeaks(filepath.Join(*Path, *Parent))
+	if err != nil || len(found) != files {
+		t.Fatalf("found %v leaks: %v, want %v", len(found), err, files)
+	}
+	for i, job := range found {
+		found[i].leakID, err = store.AddLeak(leakRows{Name: job.name, Parent: job.parent, FileName: job.file,
+			HashID: leakHashID(job.parent, job.name, job.file, job.member), LineNumber: lines, Status: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return found
+}
+
+// testProducer runs startProducer and fails the test if it does not return, the way a producer waiting for a worker hangs
+func testProducer(t *testing.T, ctx context.Context, param *JobParam) jobSummary {
+	t.Helper()
+	done := make(chan jobSummary, 1)
+	go func() { done <- startProducer(ctx, param) }()
+	select {
+	case summary := <-done:
+		return summary
+	case <-time.After(time.Minute):
+		t.Fatal("startProducer did not return in a minute")
+		return jobSummary{}
+	}
+}
+
+// every leak of the job is read once whatever the number of files and workers, run it with -race
+func TestStartProducer(t *testing.T) {
+	const lines = 50
+	for _, c := range []struct {
+		files, workers int
+	}{
+		{0, 4},
+		{1, 1},
+		{1, 4},
+		{20, 1},
+		{20, 4},
+	} {
+		t.Run(strconv.Itoa(c.files)+"files/"+strconv.Itoa(c.workers)+"workers", func(t *testing.T) {
+			testConfig(t, "-u", t.TempDir(), "-p", "leaks", "-b", "10", "-w", strconv.Itoa(c.workers))
+			store := testStore(t)
+			jobs := testJobs(t, store, c.files, lines)
+
+			summary := testProducer(t, context.Background(), &JobParam{Store: store, JobList: jobs})
+			if summary != (jobSummary{done: c.files}) {
+				t.Errorf("summary %+v, want the %v leaks done", summary, c.files)
+			}
+			for _, job := range jobs {
+				status, err := store.LeakStatus(job.leakID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status != 3 {
+					t.Errorf("leak %v has status %v, want 3 (done)", job.file, status)
+				}
+			}
+			if n := testCount(t, store, "sightings"); n != c.files*lines {
+				t.Errorf("%v sightings, want %v", n, c.files*lines)
+			}
+		})
+	}
+}
+
+// a job cancelled before it starts returns without starting a leak
+func TestStartProducerCancelled(t *testing.T) {
+	testConfig(t, "-u", t.TempDir(), "-p", "leaks", "-w", "4")
+	store := testStore(t)
+	jobs := testJobs(t, store, 20, 50)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	summary := testProducer(t, ctx, &JobParam{Store: store, JobList: jobs})
+	if summary.done+summary.stopped+summary.failed != 0 {
+		t.Errorf("summary %+v, want no leak started", summary)
+	}
+	if n := testCount(t, store, "sightings"); n != 0 {
+		t.Errorf("%v sightings, want none", n)
+	}
+}
+
+// -w 0 is refused, no worker would take the leaks
+func TestIngestNoWorkers(t *testing.T) {
+	testConfig(t, "-u", t.TempDir(), "-w", "0")
+	*DBName = filepath.Join(t.TempDir(), "creds.db")
+	err := runIngest(nil)
+	var usage usageError
+	if !errors.As(err, &usage) {
+		t.Errorf("ingest -w 0 returned %v, want a usage error", err)
+	}
+}
+
+// noAddStore is a store that cannot add the leak of the file noAdd
+type noAddStore struct {
+	Store
+	noAdd string
+}
+
+func (s noAddStore) AddLeak(leak leakRows) (int, error) {
+	if leak.FileName == s.noAdd {
+		return 0, errDiskIO
+	}
+	return s.Store.AddLeak(leak)
+}
+
+// a leak that could not be added is skipped, not read with the id 0
+func TestScanSkipsLeakNotAdded(t *testing.T) {
+	const lines = 50
+	root := t.TempDir()
+	testConfig(t, "-u", root, "-p", "leaks", "-w", "2")
+	store := noAddStore{Store: testStore(t), noAdd: "dump0.txt"}
+	for i := 0; i < 2; i++ {
+		testDump(t, filepath.Join(root, "leaks", "jobs"), "dump"+strconv.Itoa(i)+".txt", lines)
+	}
+
+	testIngest(t, context.Background(), store)
+	if n := testCount(t, store, "leaks"); n != 1 {
+		t.Errorf("%v leaks, want only dump1.txt", n)
+	}
+	if n := testCount(t, store, "sightings"); n != lines {
+		t.Errorf("%v sightings, want the %v of dump1.txt", n, lines)
+	}
+	var orphans int
+	err := store.Meta().QueryRow("SELECT count(*) FROM sightings WHERE leak NOT IN (SELECT id FROM leaks)").Scan(&orphans)
+	if err != nil || orphans != 0 {
+		t.Errorf("%v sightings without a leak (%v), want none", orphans, err)
+	}
+}
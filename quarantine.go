@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+Every line a worker cannot read is sent to the quarantine of its leak with a reason
+code, so we can tell afterwards what was thrown away and why. Depending on -rejects
+the quarantine is nothing, the rejects table, or one file per leak in a directory.
+*/
+
+var errTooLong = errors.New("line too long")
+
+// rejectReasons are the reason codes stored with the rejected lines
+var rejectReasons = map[error]string{
+	errNoSeparator: "no-separator",
+	errBadEmail:    "bad-email",
+	errBadFields:   "bad-fields",
+	errNoHeader:    "no-header",
+	errBinary:      "binary",
+	errTooLong:     "too-long",
+}
+
+// rejectedLineMax is the longest part of a rejected line we keep
+const rejectedLineMax = 1024
+
+type rejectRows struct {
+	Leak    int
+	Line    int
+	Reason  string
+	Content string
+}
+
+func rejectReason(err error) string {
+	if reason, ok := rejectReasons[err]; ok {
+		return reason
+	}
+	return "unknown"
+}
+
+// rejectSink is the quarantine of one leak
+type rejectSink interface {
+	Reject(lineNum int, err error, line string)
+	Close() error
+}
+
+// newRejectSink opens the quarantine of the leak as set with -rejects
+func newRejectSink(records chan<- record, leakID int) (rejectSink, error) {
+	switch *Rejects {
+	case "":
+		return noSink{}, nil
+	case "table":
+		return &tableSink{records: records, leakID: leakID}, nil
+	default:
+		err := os.MkdirAll(*Rejects, 0750)
+		if err != nil {
+			return nil, err
+		}
+		// appended to, a resumed or retried leak keeps the lines rejected before
+		f, err := os.OpenFile(filepath.Join(*Rejects, fmt.Sprintf("%v.rejects", leakID)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSink{file: f, w: bufio.NewWriter(f)}, nil
+	}
+}
+
+func truncateLine(line string) string {
+	if len(line) > rejectedLineMax {
+		return line[:rejectedLineMax]
+	}
+	return line
+}
+
+type noSink struct{}
+
+func (noSink) Reject(int, error, string) {}
+func (noSink) Close() error              { return nil }
+
+// fileSink writes "reason<TAB>line number<TAB>line" in the file of the leak
+type fileSink struct {
+	file *os.File
+	w    *bufio.Writer
+}
+
+func (s *fileSink) Reject(lineNum int, err error, line string) {
+	fmt.Fprintf(s.w, "%s\t%v\t%q\n", rejectReason(err), lineNum, truncateLine(line))
+}
+
+func (s *fileSink) Close() error {
+	err := s.w.Flush()
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// tableSink sends the rejected lines to the writer, for the rejects table
+type tableSink struct {
+	records chan<- record
+	leakID  int
+}
+
+func (s *tableSink) Reject(lineNum int, err error, line string) {
+	s.records <- record{kind: recordReject, reject: rejectRows{Leak: s.leakID, Line: lineNum, Reason: rejectReason(err), Content: truncateLine(line)}}
+}
+
+func (s *tableSink) Close() error { return nil }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a leak read again (resume, retry) adds to its .rejects file instead of starting it over
+func TestFileSinkAppends(t *testing.T) {
+	dir := t.TempDir()
+	testConfig(t, "-rejects", dir)
+
+	for i, line := range []string{"first", "second"} {
+		sink, err := newRejectSink(nil, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink.Reject(i+1, errNoSeparator, line)
+		err = sink.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "7.rejects")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "no-separator\t1\t\"first\"\nno-separator\t2\t\"second\"\n"
+	if string(b) != want {
+		t.Errorf("rejects file is %q, want %q", b, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("rejects file mode is %v, want 0600", info.Mode().Perm())
+	}
+}
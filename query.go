@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+stats and export read the database, they never write to it. search is in search.go.
+*/
+
+var (
+	statsTop     int
+	exportDomain string
+	exportLeak   int
+	exportFile   string
+)
+
+func statsFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	fs.IntVar(&statsTop, "top", 10, "Number of domains in the top domains")
+}
+
+func exportFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	dbKeyFlags(fs)
+	fs.StringVar(&exportDomain, "domain", "", "Only export the creds of this domain")
+	fs.IntVar(&exportLeak, "leak", 0, "Only export the creds seen in the leak with this id")
+	fs.StringVar(&exportFile, "o", "", "File to write to, the standard output if not set")
+}
+
+func runStats(fs *flag.FlagSet) error {
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	counts := []struct {
+		name  string
+		query string
+	}{
+		{"creds", "SELECT count(*) FROM (SELECT 1 FROM sightings GROUP BY identity, password)"},
+		{"sightings", "SELECT count(*) FROM sightings"},
+		{"identities", "SELECT count(*) FROM identities"},
+		{"unique passwords", "SELECT count(*) FROM passwords"},
+		{"domains", "SELECT count(*) FROM domains"},
+		{"leaks", "SELECT count(*) FROM leaks"},
+		{"leaks new", "SELECT count(*) FROM leaks WHERE status = 1"},
+		{"leaks started", "SELECT count(*) FROM leaks WHERE status = 2"},
+		{"leaks done", "SELECT count(*) FROM leaks WHERE status = 3"},
+		{"lines parsed", "SELECT coalesce(sum(parsed), 0) FROM leaks"},
+		{"lines rejected", "SELECT coalesce(sum(rejected), 0) FROM leaks"},
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, c := range counts {
+		var n int
+		err = db.QueryRow(c.query).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.name, err)
+		}
+		fmt.Fprintf(tw, "%s\t%v\n", c.name, n)
+	}
+
+	policy, err := storedPasswordPolicy(db)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tw, "passwords\t%s\n", policy)
+
+	if statsTop > 0 {
+		rows, err := db.Query(`SELECT d.domain, count(*) FROM identities i JOIN domains d ON d.id = i.domain_id
+			GROUP BY i.domain_id ORDER BY 2 DESC LIMIT ?`, statsTop)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		fmt.Fprintf(tw, "\ntop domains\tidentities\n")
+		for rows.Next() {
+			var domain string
+			var n int
+			err = rows.Scan(&domain, &n)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t%v\n", domain, n)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func runExport(fs *flag.FlagSet) (err error) {
+	query := `SELECT i.local, coalesce(d.domain, ''), coalesce(p.password, ''), i.hashID, p.hashID
+		FROM sightings s
+		JOIN identities i ON i.id = s.identity
+		JOIN passwords p ON p.id = s.password
+		LEFT JOIN domains d ON d.id = i.domain_id`
+	args := []interface{}{}
+	where := []string{}
+	if exportDomain != "" {
+		where = append(where, "d.domain = ?")
+		args = append(args, strings.ToLower(strings.TrimSpace(exportDomain)))
+	}
+	if exportLeak > 0 {
+		where = append(where, "s.leak = ?")
+		args = append(args, exportLeak)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// a cred is an identity with a password, in the order they were first seen
+	query += " GROUP BY s.identity, s.password ORDER BY min(s.id)"
+
+	db, err := openDB(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	if exportFile != "" {
+		file, err := os.Create(exportFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := file.Close(); err == nil {
+				err = e
+			}
+		}()
+		out = file
+	}
+	bw := bufio.NewWriter(out)
+
+	crypt, err := openCrypt(db)
+	if err != nil {
+		return err
+	}
+	policy, err := storedPasswordPolicy(db)
+	if err != nil {
+		return err
+	}
+	if policy != passwordPlaintext {
+		Logg(fmt.Sprintf("The passwords of %s are stored as %s, they are exported as they are stored", *DBName, policy), "Warn")
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var local, domain, password, identity, passwordID string
+		err = rows.Scan(&local, &domain, &password, &identity, &passwordID)
+		if err != nil {
+			return err
+		}
+		local, err = crypt.Decrypt(local, "local", identity)
+		if err != nil {
+			return err
+		}
+		password, err = crypt.Decrypt(password, "password", passwordID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "%s:%s\n", joinIdentity(local, domain), password)
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	Logg(fmt.Sprintf("Exported %v creds", n), "Info")
+	return bw.Flush()
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+The search is what a security team runs to find the exposed accounts of the domains it
+owns: "tr4ilgo search -domain corp.example". SearchCreds is the query itself, it can be
+used without the command. It goes over the sightings grouped by cred (an identity with a
+password), joined to the identity, its domain and the password, filtered with a
+CredQuery.
+*/
+
+// CredQuery filters the creds of SearchCreds, the empty fields are not used
+type CredQuery struct {
+	Email          string    // email, case insensitive
+	Domain         string    // domain of the email, its subdomains included
+	UsernamePrefix string    // start of the username (the part of the email before the '@')
+	Leak           string    // name of the leak directory, file or archive member the cred was seen in
+	Since          time.Time // first seen at or after
+	Until          time.Time // first seen before
+	Limit          int       // maximum number of creds, 0 for no limit
+}
+
+// CredResult is a cred found by SearchCreds
+type CredResult struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// how the password is stored, see passwordPolicies; only plaintext passwords are masked
+	PasswordPolicy string   `json:"password_policy"`
+	URL            string   `json:"url,omitempty"`
+	Domain         string   `json:"domain"`
+	FirstSeen      string   `json:"first_seen"`
+	Leaks          []string `json:"leaks"` // every leak the cred was seen in, see leakInfo.path
+}
+
+// firstSeenLayout is the part of creds.firstSeen the ranges are compared with
+const firstSeenLayout = "2006-01-02 15:04:05"
+
+// searchDialect is what the search query of each Store writes its own way
+type searchDialect struct {
+	groupBy string // the columns a cred is grouped by
+	leaks   string // aggregate of the leak ids of a cred, separated by ','
+}
+
+var sqliteSearch = searchDialect{
+	groupBy: "s.identity, s.password",
+	leaks:   "group_concat(s.leak)",
+}
+
+// likeEscaper escapes a string to be used in a LIKE pattern with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+/*
+SearchCreds calls fn for every cred matching q, sorted by username then domain. It stops
+at the first error returned by fn. The creds are streamed: a domain with millions of
+creds is never held in memory.
+
+In an encrypted database the username (identities.local) cannot be compared in SQL: the
+email is looked for in the creds of its domain, the username prefix in every cred
+matching the other filters, and they are compared once decrypted. The creds are then not
+sorted.
+*/
+func SearchCreds(db *sql.DB, q CredQuery, fn func(CredResult) error) error {
+	return searchCreds(db, sqliteSearch, q, fn)
+}
+
+// searchCreds is SearchCreds on any Store, the query is written to run on SQLite and PostgreSQL
+func searchCreds(db querier, dialect searchDialect, q CredQuery, fn func(CredResult) error) error {
+	where := []string{}
+	args := []interface{}{}
+
+	crypt, err := openCrypt(db)
+	if err != nil {
+		return err
+	}
+	email := strings.TrimSpace(q.Email)
+	if email != "" {
+		local, domain := email, ""
+		if l, d, err := splitEmail(email); err == nil {
+			local, domain = l, d
+		}
+		if domain != "" {
+			where = append(where, "lower(d.domain) = lower(?)")
+			args = append(args, domain)
+		} else {
+			where = append(where, "i.domain_id IS NULL")
+		}
+		if crypt == nil {
+			where = append(where, "lower(i.local) = lower(?)")
+			args = append(args, local)
+		}
+	}
+	if q.Domain != "" {
+		domain := strings.Trim(strings.TrimSpace(q.Domain), ".")
+		where = append(where, `(lower(d.domain) = lower(?) OR lower(d.domain) LIKE lower(?) ESCAPE '\')`)
+		args = append(args, domain, "%."+likeEscaper.Replace(domain))
+	}
+	if q.UsernamePrefix != "" && crypt == nil {
+		where = append(where, `lower(i.local) LIKE lower(?) ESCAPE '\'`)
+		args = append(args, likeEscaper.Replace(q.UsernamePrefix)+"%")
+	}
+	if q.Leak != "" {
+		where = append(where, `(s.identity, s.password) IN (SELECT f.identity, f.password FROM sightings f JOIN leaks l ON l.id = f.leak
+			WHERE l.name = ? OR l.filename = ? OR l.member = ?)`)
+		args = append(args, q.Leak, q.Leak, q.Leak)
+	}
+	// the first seen of a cred is the one of its first sighting, the dates are filtered once grouped
+	having := []string{}
+	// firstSeen is written as time.Time.String(), its first 19 chars sort as dates
+	if !q.Since.IsZero() {
+		having = append(having, "substr(min(s.firstSeen), 1, 19) >= ?")
+		args = append(args, q.Since.Local().Format(firstSeenLayout))
+	}
+	if !q.Until.IsZero() {
+		having = append(having, "substr(min(s.firstSeen), 1, 19) < ?")
+		args = append(args, q.Until.Local().Format(firstSeenLayout))
+	}
+	if len(where) == 0 && len(having) == 0 && q.UsernamePrefix == "" {
+		return fmt.Errorf("the search needs at least one filter")
+	}
+	// the filters done once decrypted come after the LIMIT
+	filterAfter := crypt != nil && (email != "" || q.UsernamePrefix != "")
+
+	query := `SELECT i.local, coalesce(p.password, ''), coalesce(max(s.url), ''),
+		coalesce(d.domain, ''), coalesce(min(s.firstSeen), ''), i.hashID, p.hashID, ` + dialect.leaks + `
+		FROM sightings s
+		JOIN identities i ON i.id = s.identity
+		JOIN passwords p ON p.id = s.password
+		LEFT JOIN domains d ON d.id = i.domain_id
+		WHERE ` + strings.Join(append(where, "1 = 1"), " AND ") + `
+		GROUP BY ` + dialect.groupBy + `
+		HAVING ` + strings.Join(append(having, "1 = 1"), " AND ") + `
+		ORDER BY i.local, d.domain, min(s.id)`
+	if q.Limit > 0 && !filterAfter {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	leaks, err := leakPaths(db)
+	if err != nil {
+		return err
+	}
+	policy, err := storedPasswordPolicy(db)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		r := CredResult{PasswordPolicy: policy}
+		var identity, password string
+		var ids sql.NullString
+		err = rows.Scan(&r.Username, &r.Password, &r.URL, &r.Domain, &r.FirstSeen, &identity, &password, &ids)
+		if err != nil {
+			return err
+		}
+		r.Username, err = crypt.Decrypt(r.Username, "local", identity)
+		if err != nil {
+			return err
+		}
+		r.Password, err = crypt.Decrypt(r.Password, "password", password)
+		if err != nil {
+			return err
+		}
+		r.Email = joinIdentity(r.Username, r.Domain)
+		if filterAfter {
+			if email != "" && !strings.EqualFold(r.Email, email) {
+				continue
+			}
+			if !strings.HasPrefix(strings.ToLower(r.Username), strings.ToLower(q.UsernamePrefix)) {
+				continue
+			}
+			if q.Limit > 0 && found >= q.Limit {
+				break
+			}
+		}
+		found++
+		// time.Time.String() adds the monotonic clock reading, it means nothing once stored
+		if i := strings.Index(r.FirstSeen, " m="); i >= 0 {
+			r.FirstSeen = r.FirstSeen[:i]
+		}
+		r.Leaks = []string{}
+		for _, id := range strings.Split(ids.String, ",") {
+			if n, err := strconv.Atoi(id); err == nil {
+				r.Leaks = append(r.Leaks, leaks[n])
+			}
+		}
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// leakPaths returns the path of every leak by id, there are few enough of them to keep them all
+func leakPaths(db querier) (map[int]string, error) {
+	rows, err := db.Query(leakInfoSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := map[int]string{}
+	for rows.Next() {
+		l, err := scanLeakInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		paths[l.id] = l.path()
+	}
+	return paths, rows.Err()
+}
+
+/*
+maskPassword keeps the first and last characters of the password and replaces the ones
+in between by '*', so the length shows but not the password: "hunter2" -> "h*****2".
+*/
+func maskPassword(password string) string {
+	n := utf8.RuneCountInString(password)
+	if n <= 2 {
+		return strings.Repeat("*", n)
+	}
+	first, _ := utf8.DecodeRuneInString(password)
+	last, _ := utf8.DecodeLastRuneInString(password)
+	return string(first) + strings.Repeat("*", n-2) + string(last)
+}
+
+var (
+	searchQuery     CredQuery
+	searchSince     string
+	searchUntil     string
+	searchOutput    string
+	searchPasswords bool
+)
+
+func searchFlags(fs *flag.FlagSet) {
+	commonFlags(fs)
+	dbKeyFlags(fs)
+	fs.StringVar(&searchQuery.Email, "email", "", "Email to look for, case insensitive")
+	fs.StringVar(&searchQuery.Domain, "domain", "", "Domain to look for, its subdomains included, eg 'corp.example'")
+	fs.StringVar(&searchQuery.UsernamePrefix, "username", "", "Start of the username (the part of the email before the '@')")
+	fs.StringVar(&searchQuery.Leak, "leak", "", "Only the creds seen in the leaks with this directory, file or archive member name")
+	fs.StringVar(&searchSince, "since", "", "Only the creds first seen on or after this date, 'YYYY-MM-DD' or 'YYYY-MM-DD hh:mm:ss'")
+	fs.StringVar(&searchUntil, "until", "", "Only the creds first seen before this date, a day given as 'YYYY-MM-DD' is included")
+	fs.IntVar(&searchQuery.Limit, "limit", 100, "Maximum number of creds printed, 0 for no limit")
+	fs.StringVar(&searchOutput, "output", "table", "Output format: table, json or csv")
+	fs.BoolVar(&searchPasswords, "show-passwords", false, "Print the passwords instead of their masked form. Passwords stored as digests or masks are always printed as they are stored")
+}
+
+// parseDate reads the -since and -until dates, day tells if only the day was given
+func parseDate(value string) (t time.Time, day bool, err error) {
+	t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+	if err == nil {
+		return t, true, nil
+	}
+	t, err = time.ParseInLocation(firstSeenLayout, value, time.Local)
+	if err == nil {
+		return t, false, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, false, fmt.Errorf("bad date %q, expecting YYYY-MM-DD or 'YYYY-MM-DD hh:mm:ss'", value)
+	}
+	return t, false, nil
+}
+
+func runSearch(fs *flag.FlagSet) (err error) {
+	q := searchQuery
+	if searchSince != "" {
+		q.Since, _, err = parseDate(searchSince)
+		if err != nil {
+			return usageError{err}
+		}
+	}
+	if searchUntil != "" {
+		var day bool
+		q.Until, day, err = parseDate(searchUntil)
+		if err != nil {
+			return usageError{err}
+		}
+		if day {
+			q.Until = q.Until.AddDate(0, 0, 1)
+		}
+	}
+	if q.Email == "" && q.Domain == "" && q.UsernamePrefix == "" && q.Leak == "" && q.Since.IsZero() && q.Until.IsZero() {
+		return usageError{fmt.Errorf("search needs at least one of -email, -domain, -username, -leak, -since or -until")}
+	}
+
+	out, err := newResultWriter(os.Stdout, searchOutput)
+	if err != nil {
+		return usageError{err}
+	}
+
+	store, err := openStore(false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	n := 0
+	err = store.Search(q, func(r CredResult) error {
+		if !searchPasswords && r.PasswordPolicy == passwordPlaintext {
+			r.Password = maskPassword(r.Password)
+		}
+		n++
+		return out.Write(r)
+	})
+	if err != nil {
+		return err
+	}
+	Logg(fmt.Sprintf("Found %v creds", n), "Info")
+	return out.Close()
+}
+
+// resultWriter prints the CredResults in one of the -output formats
+type resultWriter interface {
+	Write(r CredResult) error
+	Close() error
+}
+
+func newResultWriter(w io.Writer, format string) (resultWriter, error) {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "EMAIL\tPASSWORD\tDOMAIN\tFIRST SEEN\tLEAKS")
+		return tableWriter{tw}, nil
+	case "json":
+		return &jsonWriter{w: bufio.NewWriter(w)}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"email", "username", "password", "url", "domain", "first_seen", "leaks"})
+		return csvWriter{cw}, err
+	}
+	return nil, fmt.Errorf("unknown output %q, expecting table, json or csv", format)
+}
+
+type tableWriter struct {
+	tw *tabwriter.Writer
+}
+
+func (t tableWriter) Write(r CredResult) error {
+	firstSeen := r.FirstSeen
+	if len(firstSeen) > len(firstSeenLayout) {
+		firstSeen = firstSeen[:len(firstSeenLayout)]
+	}
+	_, err := fmt.Fprintf(t.tw, "%s\t%s\t%s\t%s\t%s\n", r.Email, r.Password, r.Domain, firstSeen, strings.Join(r.Leaks, ", "))
+	return err
+}
+
+func (t tableWriter) Close() error { return t.tw.Flush() }
+
+// jsonWriter prints a json array, one cred per line
+type jsonWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+func (j *jsonWriter) Write(r CredResult) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if j.n == 0 {
+		sep = "[\n"
+	}
+	j.n++
+	j.w.WriteString(sep)
+	_, err = j.w.Write(b)
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	if j.n == 0 {
+		j.w.WriteString("[")
+	}
+	j.w.WriteString("\n]\n")
+	return j.w.Flush()
+}
+
+type csvWriter struct {
+	cw *csv.Writer
+}
+
+func (c csvWriter) Write(r CredResult) error {
+	return c.cw.Write([]string{r.Email, r.Username, r.Password, r.URL, r.Domain, r.FirstSeen, strings.Join(r.Leaks, ";")})
+}
+
+func (c csvWriter) Close() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
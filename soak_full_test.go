@@ -0,0 +1,26 @@
+//go:build soak
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+/*
+TestSoakMemory is the real soak: testSoak with a dump of TR4IL_SOAK_MB megabytes, 4096
+(4 GB) by default. It takes a while and as much disk, so it is only built with the soak
+tag: go test -tags soak -run TestSoakMemory -timeout 0
+*/
+func TestSoakMemory(t *testing.T) {
+	size := 4096
+	if mb := os.Getenv("TR4IL_SOAK_MB"); mb != "" {
+		var err error
+		size, err = strconv.Atoi(mb)
+		if err != nil || size < 1 {
+			t.Fatalf("bad TR4IL_SOAK_MB %q, want a number of megabytes", mb)
+		}
+	}
+	testSoak(t, size)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// soakCeiling is the most heap the ingest may use, whatever the size of the dump
+const soakCeiling = 64 << 20
+
+/*
+TestSoakSmoke is a small run of testSoak, 2 MB, so a change that makes the ingest keep
+what it reads fails go test. The real soak of a few GB is TestSoakMemory, built with
+-tags soak (soak_full_test.go).
+*/
+func TestSoakSmoke(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak smoke test skipped with -short")
+	}
+	testSoak(t, 2)
+}
+
+/*
+testSoak ingests a dump of size megabytes and checks that the heap stays under
+soakCeiling all along: nothing the ingest keeps may grow with the size of the dump.
+*/
+func testSoak(t *testing.T, size int) {
+	t.Helper()
+	root := t.TempDir()
+	testConfig(t, "-u", root, "-p", "leaks", "-w", "4", "-b", "5000")
+	store := testStore(t)
+
+	// about 36 bytes a line, split in files of a million lines at most
+	lines := size << 20 / 36
+	files := 0
+	for left := lines; left > 0; left -= 1000000 {
+		n := left
+		if n > 1000000 {
+			n = 1000000
+		}
+		testDump(t, filepath.Join(root, "leaks", "soak"), "dump"+strconv.Itoa(files)+".txt", n)
+		files++
+	}
+
+	var peak uint64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var m runtime.MemStats
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak {
+				peak = m.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	start := time.Now()
+	testIngest(t, context.Background(), store)
+	close(done)
+	wg.Wait()
+
+	t.Logf("%v lines in %v files in %s, heap peak %v MB", lines, files, time.Since(start), peak>>20)
+	if peak > soakCeiling {
+		t.Errorf("heap peak of %v MB, over the ceiling of %v MB", peak>>20, soakCeiling>>20)
+	}
+	if n := testCount(t, store, "sightings"); n != lines {
+		t.Errorf("%v sightings, want %v", n, lines)
+	}
+}
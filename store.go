@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+/*
+A Store is where the leaks and their creds are kept. There are two of them:
+
+  - SQLite, the default: -d is the path of the database file
+  - PostgreSQL: -d is a postgres:// URL, see pgstore.go
+
+ingest and search go through the Store and work on both. The other commands (stats,
+export, db, leaks) only work on SQLite, they refuse a PostgreSQL -d.
+
+The creds are written by the writer (writer.go) in transactions (StoreTx), a batch of
+creds at a time. Next to the store, ingest can also write every sighting to Parquet
+files for the analytics (-parquet, see parquet.go).
+*/
+type Store interface {
+	// Migrate brings the schema up to date and returns how many migrations were applied
+	Migrate() (applied int, err error)
+	// Meta is the connection the metadata (hash version, password policy, encryption) is read and written with
+	Meta() querier
+	// LeakID returns the id of the leak with hashID, an error if there is none
+	LeakID(hashID string) (int, error)
+	// AddLeak adds the leak and returns its id
+	AddLeak(leak leakRows) (int, error)
+	// ArchiveMembers returns the members of the archive already in the leaks table, none if it was never listed
+	ArchiveMembers(parent, name, file string) ([]archiveMember, error)
+	LeakStatus(id int) (int, error)
+	SetLeakStatus(id, status int) error
+	ReadCheckpoint(id int) (checkpoint, error)
+	Begin() (StoreTx, error)
+	Search(q CredQuery, fn func(CredResult) error) error
+	// FinishLoad is called at the start and the end of an ingest, see ingest -bulk
+	FinishLoad() error
+	Close() error
+}
+
+// StoreTx is a transaction of the writer
+type StoreTx interface {
+	// WriteCreds adds the creds and returns, by leak id, how many were already in the store
+	WriteCreds(creds []record) (duplicates map[int]int, err error)
+	WriteRejects(rejects []rejectRows) error
+	SetLeakStatus(id, status int) error
+	// SaveCounts saves the line counts of a leak, the duplicates included
+	SaveCounts(id int, counts leakCounts) error
+	// SaveCheckpoint saves how far the leak was written, see checkpoint
+	SaveCheckpoint(id int, c checkpoint) error
+	// SaveFailure sets the leak to failed (4) with its error, attempts are added to the ones before
+	SaveFailure(id, attempts int, failure string) error
+	Commit() error
+	Rollback() error
+}
+
+// readArchiveMembers reads the members of an archive from the leaks table, see Store.ArchiveMembers
+func readArchiveMembers(db querier, parent, name, file string) ([]archiveMember, error) {
+	rows, err := db.Query(`SELECT member, coalesce(linenumber, -1) FROM leaks
+		WHERE parent = ? AND name = ? AND filename = ? AND member != '' ORDER BY id`, parent, name, file)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []archiveMember
+	for rows.Next() {
+		var m archiveMember
+		err = rows.Scan(&m.name, &m.lines)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// querier is what *sql.DB, *sql.Tx and pgDB have in common
+type querier interface {
+	execer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// isPostgres tells if -d is the URL of a PostgreSQL database rather than a SQLite file
+func isPostgres(name string) bool {
+	return strings.HasPrefix(name, "postgres://") || strings.HasPrefix(name, "postgresql://")
+}
+
+/*
+openStore opens the -d store, with its schema up to date. create is the one of openDB,
+a PostgreSQL database has to exist on the server (its tables are made if needed).
+*/
+func openStore(create bool) (Store, error) {
+	if !isPostgres(*DBName) {
+		db, err := openDB(create)
+		if err != nil {
+			return nil, err
+		}
+		return newSQLiteStore(db), nil
+	}
+
+	err := loadDBKey()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the database key: %s", err)
+	}
+	s, err := openPGStore(*DBName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.Migrate()
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("could not migrate the PostgreSQL database: %s", err)
+	}
+	return s, nil
+}
+
+// sqliteStore is the Store of a SQLite file, it is the code of dbIO.go and of the writer
+type sqliteStore struct {
+	db      *sql.DB
+	domains map[string]int // domain -> domains.id, a cache for the writer
+}
+
+func newSQLiteStore(db *sql.DB) *sqliteStore {
+	return &sqliteStore{db: db, domains: map[string]int{}}
+}
+
+func (s *sqliteStore) Migrate() (int, error) { return migrateDB(s.db) }
+func (s *sqliteStore) Meta() querier         { return s.db }
+func (s *sqliteStore) Close() error          { return s.db.Close() }
+
+func (s *sqliteStore) LeakID(hashID string) (int, error) {
+	return GetForeignKey(s.db, "leaks", "hashID", hashID)
+}
+
+func (s *sqliteStore) AddLeak(leak leakRows) (int, error) {
+	err := insertLeaks(s.db, []leakRows{leak})
+	if err != nil {
+		return 0, err
+	}
+	return s.LeakID(leak.HashID)
+}
+
+func (s *sqliteStore) ArchiveMembers(parent, name, file string) ([]archiveMember, error) {
+	return readArchiveMembers(s.db, parent, name, file)
+}
+
+func (s *sqliteStore) LeakStatus(id int) (int, error)            { return ReadStatus(s.db, id) }
+func (s *sqliteStore) SetLeakStatus(id, status int) error        { return ChangeStatus(s.db, status, id) }
+func (s *sqliteStore) ReadCheckpoint(id int) (checkpoint, error) { return ReadCheckpoint(s.db, id) }
+
+func (s *sqliteStore) Search(q CredQuery, fn func(CredResult) error) error {
+	return SearchCreds(s.db, q, fn)
+}
+
+// sqliteWriteSQL are the statements of a sqliteTx, prepared at the start of every transaction
+var sqliteWriteSQL = map[string]string{
+	"insertDomain":   "INSERT OR IGNORE INTO domains(domain) VALUES (?)",
+	"selectDomain":   "SELECT id FROM domains WHERE domain = ?",
+	"insertIdentity": "INSERT INTO identities(hashID, local, domain_id) VALUES (?, ?, ?) ON CONFLICT(hashID) DO NOTHING",
+	"selectIdentity": "SELECT id FROM identities WHERE hashID = ?",
+	"insertPassword": "INSERT INTO passwords(hashID, password) VALUES (?, ?) ON CONFLICT(hashID) DO NOTHING",
+	"selectPassword": "SELECT id FROM passwords WHERE hashID = ?",
+	"selectCred":     "SELECT EXISTS (SELECT 1 FROM sightings WHERE identity = ? AND password = ?)",
+	"insertSighting": "INSERT INTO sightings(identity, password, leak, line, url, firstSeen) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+	"updateCounts":   "UPDATE leaks SET parsed = ?, duplicates = ?, rejected = ? WHERE id = ?",
+	"checkpoint":     "UPDATE leaks SET byteoffset = ?, lineoffset = ?, parsed = ?, duplicates = ?, rejected = ? WHERE id = ?",
+	"updateStatus":   "UPDATE leaks SET status = ? WHERE id = ?",
+	"failure":        "UPDATE leaks SET status = 4, error = ?, attempts = attempts + ? WHERE id = ?",
+}
+
+/*
+sqliteTx writes the creds one at a time with statements prepared once per transaction,
+and lets the UNIQUE constraints do the dedupe (INSERT OR IGNORE / ON CONFLICT).
+*/
+type sqliteTx struct {
+	store *sqliteStore
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+func (s *sqliteStore) FinishLoad() error { return mergeBulkLoad(s.db) }
+
+func (s *sqliteStore) Begin() (StoreTx, error) {
+	if *BulkLoad {
+		return s.beginBulk()
+	}
+	return s.beginSQLite()
+}
+
+// beginSQLite begins a transaction, tried sqliteBusyRetries more times while SQLite is busy
+func (s *sqliteStore) beginSQLite() (*sqliteTx, error) {
+	var tx *sql.Tx
+	var err error
+	for try := 0; ; try++ {
+		tx, err = s.db.Begin()
+		if !isBusy(countBusy(err)) || try == sqliteBusyRetries {
+			break
+		}
+		// Begin waited sqliteBusyTimeout already
+		metricSQLiteRetries.Inc()
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &sqliteTx{store: s, tx: tx, stmts: map[string]*sql.Stmt{}}
+	for name, query := range sqliteWriteSQL {
+		t.stmts[name], err = tx.Prepare(query)
+		if err != nil {
+			t.Rollback()
+			return nil, fmt.Errorf("preparing %s: %s", name, err)
+		}
+	}
+	return t, nil
+}
+
+func (t *sqliteTx) closeStmts() {
+	for _, stmt := range t.stmts {
+		stmt.Close()
+	}
+}
+
+func (t *sqliteTx) Commit() error {
+	t.closeStmts()
+	return countBusy(t.tx.Commit())
+}
+
+func (t *sqliteTx) Rollback() error {
+	t.closeStmts()
+	// the domains added in the transaction are gone
+	t.store.domains = map[string]int{}
+	return t.tx.Rollback()
+}
+
+/*
+WriteCreds writes the creds in order. It stops at the first cred that cannot be written:
+skipping it would let the checkpoint of its leak go past a line that is not in the
+database, the writer rolls the transaction back and fails its leaks instead.
+*/
+func (t *sqliteTx) WriteCreds(creds []record) (map[int]int, error) {
+	duplicates := map[int]int{}
+	for _, r := range creds {
+		known, err := t.writeCred(r)
+		if err != nil {
+			return nil, fmt.Errorf("cred of line %v of leak %v: %w", r.line, r.sighting.Leak, countBusy(err))
+		}
+		if known {
+			duplicates[r.sighting.Leak]++
+		}
+	}
+	return duplicates, nil
+}
+
+/*
+writeCred adds the identity and the password of the record if they are new, and the
+sighting of the cred in its leak. The cred is known when the database already had a
+sighting of the same identity with the same password, in any leak.
+*/
+func (t *sqliteTx) writeCred(r record) (known bool, err error) {
+	var domain interface{}
+	if r.domain != "" {
+		r.identity.Domain, err = t.domainID(r.domain)
+		if err != nil {
+			return false, err
+		}
+		domain = r.identity.Domain
+	}
+
+	identity, newIdentity, err := insertID(t.stmts["insertIdentity"], t.stmts["selectIdentity"], r.identity.HashID, r.identity.Local, domain)
+	if err != nil {
+		return false, err
+	}
+	password, newPassword, err := insertID(t.stmts["insertPassword"], t.stmts["selectPassword"], r.password.HashID, r.password.Password)
+	if err != nil {
+		return false, err
+	}
+
+	if !newIdentity && !newPassword {
+		err = t.stmts["selectCred"].QueryRow(identity, password).Scan(&known)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	s := r.sighting
+	_, err = t.stmts["insertSighting"].Exec(identity, password, s.Leak, s.Line, s.URL, s.FirstSeen)
+	return known, err
+}
+
+/*
+insertID runs insert, an INSERT ... ON CONFLICT(hashID) DO NOTHING with the hashID as its
+first argument, and returns the id of the row with that hashID. inserted tells if the row
+is new.
+*/
+func insertID(insert, sel *sql.Stmt, hashID string, args ...interface{}) (id int64, inserted bool, err error) {
+	res, err := insert.Exec(append([]interface{}{hashID}, args...)...)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	if n > 0 {
+		id, err = res.LastInsertId()
+		return id, true, err
+	}
+	err = sel.QueryRow(hashID).Scan(&id)
+	return id, false, err
+}
+
+// domainID returns the id of the domain in domains, adding it if needed
+func (t *sqliteTx) domainID(domain string) (id int, err error) {
+	if id, ok := t.store.domains[domain]; ok {
+		return id, nil
+	}
+	if len(t.store.domains) >= domainCacheSize {
+		t.store.domains = map[string]int{}
+	}
+	_, err = t.stmts["insertDomain"].Exec(domain)
+	if err != nil {
+		return 0, err
+	}
+	err = t.stmts["selectDomain"].QueryRow(domain).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	t.store.domains[domain] = id
+	return id, nil
+}
+
+func (t *sqliteTx) WriteRejects(rejects []rejectRows) error {
+	return countBusy(insertRejects(t.tx, rejects))
+}
+
+func (t *sqliteTx) SetLeakStatus(id, status int) error {
+	_, err := t.stmts["updateStatus"].Exec(status, id)
+	return countBusy(err)
+}
+
+func (t *sqliteTx) SaveCounts(id int, counts leakCounts) error {
+	_, err := t.stmts["updateCounts"].Exec(counts.parsed, counts.duplicates, counts.rejected, id)
+	return countBusy(err)
+}
+
+func (t *sqliteTx) SaveFailure(id, attempts int, failure string) error {
+	_, err := t.stmts["failure"].Exec(failure, attempts, id)
+	return countBusy(err)
+}
+
+func (t *sqliteTx) SaveCheckpoint(id int, c checkpoint) error {
+	_, err := t.stmts["checkpoint"].Exec(c.offset, c.line, c.counts.parsed, c.counts.duplicates, c.counts.rejected, id)
+	return countBusy(err)
+}
@@ -0,0 +1,51 @@
+-- A database of the first tr4ilGo, before schema_version: the tables of its CreateTable,
+-- as they were, and a few creds. Used by TestMigrateV1Fixture.
+CREATE TABLE hosts (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
+		"domain" TEXT UNIQUE,
+		"smtp" TEXT,
+		"smtpPort" INTEGER,
+		"imap" TEXT,
+		"imapPort" INTEGER 		
+	  );
+
+CREATE TABLE leaks (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
+		"name" TEXT NOT NULL,
+		"parent" TEXT NOT NULL,
+		"filename" TEXT NOT NULL, 
+		"hashID" TEXT UNIQUE NOT NULL,
+		"date" TEXT,
+		"website" TEXT,
+		"linenumber" INTEGER,
+		"status" INTEGER
+	  );
+
+CREATE TABLE creds (
+		"id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,		
+		"email" TEXT NOT NULL,
+		"username" TEXT,
+		"password" TEXT,
+		"hashID" TEXT NOT NULL UNIQUE,
+		"valid" INTEGER NOT NULL DEFAULT 0,
+		"host" INTEGER, 
+		"firstSeen" TEXT,
+		"leak" INTEGER, 
+		FOREIGN KEY(host) REFERENCES hosts(id),
+		FOREIGN KEY(leak) REFERENCES leaks(id)
+	  );
+
+-- The rows are the way the first tr4ilGo wrote them: the leaks go through status 1 (new),
+-- 2 (reading) and 3 (done), the creds always have leak 0, the dates are fmt.Sprint(time.Now())
+-- and the hashIDs are hex SHA-1.
+INSERT INTO hosts(id, domain) VALUES (1, 'example.com'), (2, 'mail.org');
+
+INSERT INTO leaks(id, name, parent, filename, hashID, date, website, linenumber, status) VALUES
+	(1, 'combo', 'Collection 1', 'combo.txt', '3f786850e387550fdab836ed7e6dc881de23001b', '2021-03-04 10:00:00.123456789 +0100 CET m=+0.012345678', 'reddit', 3, 3),
+	(2, 'other', 'Collection 1', 'other.txt', '89e6c98d92887913cadf06b2adb97f26cde4849b', '2021-03-04 10:00:00.223456789 +0100 CET m=+0.112345678', 'reddit', 2, 2),
+	(3, 'later', 'Collection 1', 'later.txt', '2b66fd261ee5c6cfc8de7fa466bab600bcfe4f69', '2021-03-04 10:00:00.323456789 +0100 CET m=+0.212345678', 'reddit', 5, 1);
+
+INSERT INTO creds(id, email, username, password, hashID, valid, host, firstSeen, leak) VALUES
+	(1, 'john@example.com', 'john', 'hunter2', 'a94a8fe5ccb19ba61c4c0873d391e987982fbbd3', 0, 1, '2021-03-04 10:00:01.101 +0100 CET m=+1.001', 0),
+	(2, 'jane@example.com', 'jane', 'p@ss:word', '4e1243bd22c66e76c2ba9eddc1f91394e57f9f83', 0, 1, '2021-03-04 10:00:01.102 +0100 CET m=+1.002', 0),
+	(3, 'bob@mail.org', 'bob', 'secret', '1ff2b3704aede04eecb51e50ca698efd50a1379b', 0, 2, '2021-03-04 10:00:02.201 +0100 CET m=+2.101', 0);
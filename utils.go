@@ -8,14 +8,20 @@ import (
 	"os"
 
 	"github.com/evilsocket/islazy/tui"
-	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
 )
 
-func LineCounter(f string) (int, error) {
-	file, err := os.Open(f)
+// countLeakLines opens the (decompressed) leak file of the job and counts its lines
+func countLeakLines(job dirStruct) (int, error) {
+	r, err := openLeak(job)
 	if err != nil {
 		return -1, err
 	}
+	defer r.Close()
+	return LineCounter(r)
+}
+
+func LineCounter(file io.Reader) (int, error) {
 	r := bufio.NewReader(file)
 	buf := make([]byte, 32*1024)
 	count := 0
@@ -29,37 +35,11 @@ func LineCounter(f string) (int, error) {
 		case err == io.EOF:
 			return count, nil
 		case err != nil:
-			return count, nil
+			return count, err
 		}
 	}
 }
 
-func CheckErr(err error, level, text string) {
-	if err != nil {
-		Logg(fmt.Sprint(tui.Red(text), " ", err), level)
-	}
-}
-
-func Logg(text, level string) {
-	switch level {
-	case "Fatal":
-		msg = tui.Red(text)
-		log.Fatal(msg)
-	case "Error":
-		msg = tui.Red(text)
-		log.Error(msg)
-	case "Warn":
-		msg = tui.Yellow(text)
-		log.Warn(msg)
-	case "Info":
-		msg = tui.Green(text)
-		log.Info(msg)
-	case "Debug":
-		msg = tui.Blue(text)
-		log.Debug(msg)
-	}
-}
-
 //ASCIIArt simple visual printing of the logo in terminal. Ran immediately in main hence exported
 func ASCIIArt() {
 	asciiArt :=
@@ -72,7 +52,7 @@ $$$$$$$$ $$$  $$$   $$$$$$ $$$$$$$$ $$$              $$$$$$$$ $$$$$$$$
   $$$$	 $$$  $$$      $$$ $$$$$$$$ $$$$$$$$         $$$$$$$$ $$$$$$$$  $$$$
   $$$$	 $$$   $$$     $$$ $$$$$$$$ $$$$$$$$          $$$$$$    $$$$     $$
                                             GO - v0.1 guanicoe`
-	fmt.Println(tui.Wrap(tui.BOLD+tui.RED, asciiArt))
+	fmt.Println(wrapTTY(tui.BOLD+tui.RED, asciiArt))
 }
 
 func printParam() {
@@ -85,8 +65,17 @@ func printParam() {
  Parent directory:    %s
    Number workers:    %v
          Reset DB:    %t
+        Passwords:    %s
           Verbose:    %s
 	 `,
-		*DBName, *Path, *Parent, *NWorkers, *CleanDB, LogLvl)
-	fmt.Println(tui.Wrap(tui.BOLD+tui.YELLOW, paramText))
+		*DBName, *Path, *Parent, *NWorkers, *CleanDB, *PasswordPolicy, LogLvl)
+	fmt.Println(wrapTTY(tui.BOLD+tui.YELLOW, paramText))
+}
+
+// wrapTTY is tui.Wrap when stdout is a terminal, the escape codes would end up in the file or the pipe otherwise
+func wrapTTY(effect, text string) string {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return text
+	}
+	return tui.Wrap(effect, text)
 }
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/evilsocket/islazy/tui"
+)
+
+// the output of go test is not a terminal, the text is printed without escape codes
+func TestWrapTTY(t *testing.T) {
+	if got := wrapTTY(tui.BOLD+tui.RED, "tr4ilGo"); got != "tr4ilGo" {
+		t.Errorf("wrapTTY returned %q, want the text as it is", got)
+	}
+}
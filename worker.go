@@ -3,139 +3,319 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/sha1"
-	"database/sql"
-	"encoding/hex"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
 	"strings"
-	"sync"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3" // Import go-sqlite3 library
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 )
 
 type worker struct {
-	CTX       context.Context
-	DB        *sql.DB
-	Mutex     *sync.Mutex
-	ID        int
-	Work      chan workRequest
-	PugsQueue chan chan workRequest
-	Result    chan workOutput
+	CTX     context.Context
+	ID      int
+	Records chan<- record
+
+	busy      prometheus.Counter // time spent on leaks, see addBusy
+	busySince time.Time          // last time added to busy, zero while the worker waits for a leak
 }
 
-// NewWorker creates, and returns a new Worker object. Its only argument
-// is a channel that the worker can add itself to whenever it is done its
-// work.
-func workerNew(ctx context.Context, id int, db *sql.DB, mutex *sync.Mutex, pugsQueue chan chan workRequest, result chan workOutput) worker {
+// NewWorker creates, and returns a new Worker object. The worker does not touch the
+// database, what it reads is sent to the writer on records.
+func workerNew(ctx context.Context, id int, records chan<- record) worker {
 
 	worker := worker{
-		CTX:       ctx,
-		DB:        db,
-		Mutex:     mutex,
-		ID:        id,
-		Work:      make(chan workRequest),
-		PugsQueue: pugsQueue,
-		Result:    result,
+		CTX:     ctx,
+		ID:      id,
+		Records: records,
+		busy:    workerBusy(id),
 	}
 
 	return worker
 }
 
-func (w *worker) Start() {
-
-	go func() {
-		for {
-			w.PugsQueue <- w.Work
-			select {
-			case <-w.CTX.Done():
-				return
-			case work := <-w.Work:
-				err := processFile(work, w)
-				r := workOutput{
-					Work:  work,
-					Error: err,
-				}
-				w.Result <- r
+/*
+Run reads the leaks of jobs one at a time and sends their result on results, it returns
+once jobs is closed and empty. A leak that fails is not an error of the worker: it is
+tried again -retries times, waiting retryDelay then twice as long each time, from the line
+it got to, and its last error is in the result. Every job taken gets a result, even when
+the context is cancelled (errInterrupted), so the producer knows what was stopped.
+*/
+func (w *worker) Run(jobs <-chan workRequest, results chan<- workOutput) error {
+	for work := range jobs {
+		fields := w.fields(work.Job)
+		w.busySince = time.Now()
+		reached, err := processFile(work, w)
+		attempts := 1
+		for delay := retryDelay; err != nil && err != errInterrupted && attempts <= *Retries; delay *= 2 {
+			CheckErrWith(fields, err, "Warn", fmt.Sprintf("Leak failed, trying again in %s (%v/%v)", delay, attempts, *Retries))
+			if !w.sleep(delay) {
+				// it stays started, the next ingest resumes it
+				err = errInterrupted
+				break
 			}
+			metricRetries.Inc()
+			work.Job.checkpoint = reached
+			reached, err = processFile(work, w)
+			attempts++
 		}
-	}()
+		// the time waiting to try again counts as busy, the worker takes no other leak
+		w.addBusy()
+		w.busySince = time.Time{}
+		results <- workOutput{
+			Work:     work,
+			Counts:   reached.counts,
+			Attempts: attempts,
+			Error:    err,
+		}
+	}
+	return nil
+}
+
+/*
+addBusy adds the time since the last call to the busy time of the worker. It is called
+every -b lines and at the end of a leak, so the utilisation of a worker shows while it
+reads a large leak, not only once it is done.
+*/
+func (w *worker) addBusy() {
+	now := time.Now()
+	if !w.busySince.IsZero() {
+		w.busy.Add(now.Sub(w.busySince).Seconds())
+	}
+	w.busySince = now
 }
 
-func processFile(work workRequest, w *worker) error {
+// fields are the log fields of the lines of the worker about the leak of job
+func (w *worker) fields(job dirStruct) log.Fields {
+	fields := leakFields(job)
+	fields["worker_id"] = w.ID
+	return fields
+}
+
+// retryDelay is how long a worker waits before trying a leak that failed again, doubled every time
+const retryDelay = 2 * time.Second
+
+// sleep waits for d, it returns false if the context of the worker was cancelled first
+func (w *worker) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-w.CTX.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// maxScanLine is the size of the scanner buffer, longer lines are rejected as too-long, see lineScanner
+const maxScanLine = 1024 * 1024
+
+/*
+processFile reads the leak of the job and sends its creds to the writer. Every cred sent
+carries the byte offset of the end of its line and the counts so far, the writer saves
+them in the leaks table when it commits, so a leak that was not finished starts again
+from its last committed line (job.checkpoint) instead of from the top. When the context
+of the worker is cancelled it stops after the line it is on and returns errInterrupted.
 
-	filePath := filepath.Join(work.Job.path, work.Job.file)
-	file, err := os.Open(filePath)
+reached is the end of the last line handled, with the counts up to it: everything before
+it was sent to the writer, a retry starts from there.
+*/
+func processFile(work workRequest, w *worker) (reached checkpoint, err error) {
+	job := work.Job
+	reached = job.checkpoint
+
+	file, err := openLeak(job)
 	if err != nil {
-		return err
+		return reached, err
 	}
-	scanner := bufio.NewScanner(file)
+	defer func() { file.Close() }()
+	scanner := newLineScanner(file, 0)
 
-	data := []credRows{}
-	var email, password, username, domain, seperator string
-	h := sha1.New()
+	hasher := newCredHasher()
+	storer := newPasswordStorer()
 	// re := regexp.MustCompile(`.+@+\w+\.{1}\w+`)
-	err = ChangeStatus(w.DB, 2, work.Job.leakID)
-	CheckErr(err, "Error", "Trying to change leaks status so 1")
-	for scanner.Scan() {
-		line := scanner.Text()
-		// email = re.MatchString(line)
-		// password = strings.Split(line, email)[1]
-		switch {
-		case strings.Contains(line, ":"):
-			seperator = ":"
-		case strings.Contains(line, ";"):
-			seperator = ";"
+	counts := job.checkpoint.counts
+	w.Records <- record{kind: recordStart, leakID: job.leakID, counts: counts}
+
+	rejects, err := newRejectSink(w.Records, job.leakID)
+	if err != nil {
+		return reached, err
+	}
+	defer func() {
+		err := rejects.Close()
+		CheckErrWith(w.fields(job), err, "Warn", "Could not close the quarantine of the leak")
+	}()
+
+	// the first lines are kept aside to guess the format of the file
+	type sampleLine struct {
+		raw     string
+		end     int64
+		tooLong bool
+	}
+	rawSample := []sampleLine{}
+	sample := []string{}
+	for len(rawSample) < sniffLines && scanner.Scan() {
+		rawSample = append(rawSample, sampleLine{raw: scanner.Text(), end: scanner.offset, tooLong: scanner.tooLong})
+		line, err := cleanLine(scanner.Text())
+		if err == nil && line != "" && !scanner.tooLong && len(line) <= *MaxLineLength {
+			sample = append(sample, line)
 		}
-		split := strings.Split(line, seperator)
-		if len(split) == 2 {
-			email = split[0]
-			password = split[1]
-			split = strings.Split(email, "@")
-			if len(split) == 2 {
-				username = split[0]
-				domain = split[1]
-			} else {
-				continue
-			}
-		} else {
-			continue
+	}
+	parser, err := parserFor(job, sample)
+	if err != nil {
+		return reached, err
+	}
+	LoggWith(w.fields(job), fmt.Sprintf("Reading with the %s parser", parser.Name()), "Debug")
+
+	read := metricLines.WithLabelValues("read")
+	parsed := metricLines.WithLabelValues("parsed")
+	rejected := metricLines.WithLabelValues("rejected")
+
+	var lineNum int
+	reject := func(err error, line string) {
+		counts.rejected++
+		rejected.Inc()
+		rejects.Reject(lineNum, err, line)
+	}
+
+	handleLine := func(raw string, end int64, tooLong bool) {
+		lineNum++
+		read.Inc()
+		if lineNum%*BatchSize == 0 {
+			w.addBusy()
+		}
+		defer func() { reached = checkpoint{offset: end, line: lineNum, counts: counts} }()
+		if tooLong || len(raw) > *MaxLineLength {
+			reject(errTooLong, raw)
+			return
+		}
+		line, err := cleanLine(raw)
+		if err != nil {
+			reject(err, raw)
+			return
 		}
+		if line == "" {
+			return
+		}
+		cred, err := parser.Parse(line)
+		if err == errHeader {
+			return
+		}
+		if err != nil {
+			reject(err, raw)
+			return
+		}
+		counts.parsed++
+		parsed.Inc()
+
+		// the local part is the username the parsers cut from the email
+		identity := hasher.IdentityID(cred.Email)
+		// the hashID is the one of the password, not of what the policy stores
+		stored := storer.Store(cred.Password)
+		password := hasher.PasswordID(cred.Password)
 
-		h.Write([]byte(fmt.Sprint(email, password)))
-		hash := hex.EncodeToString(h.Sum(nil))
-
-		w.Mutex.Lock()
-		id := 0
-		id, _ = GetForeignKey(w.DB, "creds", "hashID", hash)
-		// CheckErr(err, "Debug", fmt.Sprintf("Could not get foreignkey for creds hasgID: %v", id))
-		w.Mutex.Unlock()
-		if id == 0 {
-			w.Mutex.Lock()
-			id, err = GetForeignKey(w.DB, "hosts", "domain", domain)
-			if err != nil {
-				// log.Println(fmt.Sprintf("Could not get row : %s", err))
-				err = InsertRow(w.DB, hostsTable, []hostRows{{Domain: domain}})
-				CheckErr(err, "Warn", fmt.Sprintf("Could not add row : %s ||| line: %s", err, line))
-				id, err = GetForeignKey(w.DB, "hosts", "domain", domain)
-				CheckErr(err, "Warn", fmt.Sprintf("Could not GetForeignKey : %s ||| line: %s", err, line))
+		w.Records <- record{
+			kind:     recordCred,
+			identity: identityRows{HashID: identity, Local: credCrypt.Encrypt(cred.Username, "local", identity)},
+			password: passwordRows{HashID: password, Password: credCrypt.Encrypt(stored, "password", password)},
+			sighting: sightingRows{Leak: job.leakID, Line: lineNum, URL: cred.URL, FirstSeen: fmt.Sprint(time.Now())},
+			domain:   strings.ToLower(cred.Domain), // one row per domain, whatever the case in the leaks
+			line:     lineNum,
+			offset:   end,
+			counts:   counts,
+		}
+	}
+
+	resume := job.checkpoint.offset
+	if resume > 0 {
+		fields := w.fields(job)
+		fields["lines"] = job.checkpoint.line
+		LoggWith(fields, fmt.Sprintf("Resuming the leak at byte %v", resume), "Info")
+	}
+
+	for _, l := range rawSample {
+		if l.end <= resume {
+			// already in the database, only given to the parser for its state (csv header)
+			lineNum++
+			if line, err := cleanLine(l.raw); err == nil {
+				parser.Parse(line)
 			}
+			continue
+		}
+		handleLine(l.raw, l.end, l.tooLong)
+	}
 
-			w.Mutex.Unlock()
-			leakID := 0
-			data = append(data, credRows{Email: email, HashID: hash, Username: username, Password: password, FirstSeen: fmt.Sprint(time.Now()), Host: id, Leak: leakID})
+	if len(rawSample) > 0 && resume > rawSample[len(rawSample)-1].end {
+		// the checkpoint is further than the sample, jump straight to it
+		file.Close()
+		file, err = openLeakAt(job, resume)
+		if err != nil {
+			return reached, err
 		}
-		if len(data) > *BatchSize {
-			w.Mutex.Lock()
-			err = InsertRow(w.DB, credsTable, data)
-			w.Mutex.Unlock()
-			CheckErr(err, "Warn", fmt.Sprintf("Could not add row : %s, ", err))
-			data = []credRows{}
+		scanner = newLineScanner(file, resume)
+		lineNum = job.checkpoint.line
+	}
+
+	for scanner.Scan() {
+		if w.interrupted() {
+			return reached, errInterrupted
 		}
+		handleLine(scanner.Text(), scanner.offset, scanner.tooLong)
+	}
+
+	return reached, scanner.Err()
+}
 
+/*
+lineScanner reads the lines of a leak and keeps the byte offset of the end of the last
+line scanned, for the checkpoints. A line longer than maxScanLine does not stop the
+reading: the scanner goes on to its end, Text() is its first rejectedLineMax bytes and
+tooLong is set, so it is rejected as too-long like the lines longer than -maxline.
+*/
+type lineScanner struct {
+	*bufio.Scanner
+	offset  int64
+	tooLong bool   // the last line scanned was longer than maxScanLine
+	head    []byte // start of the over-long line being skipped, nil if there is none
+}
+
+// newLineScanner returns a line scanner on r, start is the offset r starts at
+func newLineScanner(r io.Reader, start int64) *lineScanner {
+	s := &lineScanner{Scanner: bufio.NewScanner(r), offset: start}
+	s.Buffer(make([]byte, 64*1024), maxScanLine)
+	s.Split(s.split)
+	return s
+}
+
+// split is bufio.ScanLines skipping over the lines that do not fit the buffer. It is only
+// called by Scan, so after Scan the offset is the end of the line it returned.
+func (s *lineScanner) split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	advance, token, err = bufio.ScanLines(data, atEOF)
+	switch {
+	case token == nil && len(data) >= maxScanLine:
+		// a full buffer and no end of line, keep the start of the line and drop the rest
+		if s.head == nil {
+			s.head = append([]byte{}, data[:rejectedLineMax]...)
+		}
+		advance = len(data)
+	case s.head != nil && (token != nil || atEOF):
+		// end of the over-long line
+		token, s.head = s.head, nil
+		s.tooLong = true
+	case token != nil:
+		s.tooLong = false
 	}
+	s.offset += int64(advance)
+	return advance, token, err
+}
 
-	return nil
+// interrupted tells if the context of the worker was cancelled, without blocking
+func (w *worker) interrupted() bool {
+	select {
+	case <-w.CTX.Done():
+		return true
+	default:
+		return false
+	}
 }
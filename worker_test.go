@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineScannerTooLong(t *testing.T) {
+	long := strings.Repeat("x", 2*maxScanLine+123)
+	lines := []string{"a@b.com:pw", long, "c@d.com:pw", long + "\r", ""}
+	input := strings.Join(lines, "\n") + "\n" + "noeol@b.com:" + long
+
+	want := []struct {
+		text    string
+		tooLong bool
+	}{
+		{"a@b.com:pw", false},
+		{long[:rejectedLineMax], true},
+		{"c@d.com:pw", false},
+		{long[:rejectedLineMax], true},
+		{"", false},
+		{"noeol@b.com:" + long[:rejectedLineMax-len("noeol@b.com:")], true},
+	}
+
+	scanner := newLineScanner(strings.NewReader(input), 0)
+	var end int64
+	for i, w := range want {
+		if !scanner.Scan() {
+			t.Fatalf("line %v: scan stopped: %v", i+1, scanner.Err())
+		}
+		if scanner.Text() != w.text || scanner.tooLong != w.tooLong {
+			t.Errorf("line %v: got %.20q... tooLong %v, want %.20q... tooLong %v", i+1, scanner.Text(), scanner.tooLong, w.text, w.tooLong)
+		}
+		if i < len(lines) {
+			end += int64(len(lines[i]) + 1)
+			if scanner.offset != end {
+				t.Errorf("line %v: offset %v, want %v", i+1, scanner.offset, end)
+			}
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("scanned a line after the last one: %.20q", scanner.Text())
+	}
+	if scanner.Err() != nil {
+		t.Errorf("scanner error: %s", scanner.Err())
+	}
+	if scanner.offset != int64(len(input)) {
+		t.Errorf("offset at the end %v, want %v", scanner.offset, len(input))
+	}
+}
+
+// testResumed checks that the leak of the store was read once and only once: every line a cred, done, no line twice
+func testResumed(t *testing.T, store Store, leakID, lines int) {
+	t.Helper()
+	status, err := store.LeakStatus(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 3 {
+		t.Errorf("leak has status %v after the resume, want 3 (done)", status)
+	}
+	var sightings, distinct, parsed int
+	err = store.Meta().QueryRow("SELECT count(*), count(DISTINCT line) FROM sightings WHERE leak = ?", leakID).Scan(&sightings, &distinct)
+	if err == nil {
+		err = store.Meta().QueryRow("SELECT parsed FROM leaks WHERE id = ?", leakID).Scan(&parsed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sightings != lines || distinct != lines {
+		t.Errorf("%v sightings of %v lines, want one for each of the %v lines", sightings, distinct, lines)
+	}
+	if parsed != lines {
+		t.Errorf("leak has %v lines parsed, want %v", parsed, lines)
+	}
+	if n := testCount(t, store, "identities"); n != lines {
+		t.Errorf("%v identities, want %v", n, lines)
+	}
+}
+
+/*
+TestResumeMidFile stops processFile in the middle of a leak, the way SIGINT does, then
+ingests again: the leak has to go on from its checkpoint, without losing or repeating a line.
+*/
+func TestResumeMidFile(t *testing.T) {
+	const lines, stopAt = 5000, 2500
+	root := t.TempDir()
+	testConfig(t, "-u", root, "-p", "leaks", "-b", "100")
+	store := testStore(t)
+	testDump(t, filepath.Join(root, "leaks", "big"), "dump.txt", lines)
+
+	found, err := discoverLeaks(filepath.Join(root, "leaks"))
+	if err != nil || len(found) != 1 {
+		t.Fatalf("found %v leaks: %v", len(found), err)
+	}
+	job := found[0]
+	job.leakID, err = store.AddLeak(leakRows{Name: job.name, Parent: job.parent, FileName: job.file,
+		HashID: leakHashID(job.parent, job.name, job.file, job.member), LineNumber: lines, Status: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker is stopped once stopAt creds went to the writer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wr := startWriter(store, nil, 100)
+	records := make(chan record)
+	go func() {
+		creds := 0
+		for r := range records {
+			if r.kind == recordCred {
+				creds++
+				if creds == stopAt {
+					cancel()
+				}
+			}
+			wr.records <- r
+		}
+		close(wr.records)
+	}()
+	w := workerNew(ctx, 1, records)
+	reached, err := processFile(workRequest{Job: job}, &w)
+	close(records)
+	<-wr.done
+	if err != errInterrupted {
+		t.Fatalf("processFile returned %v, want errInterrupted", err)
+	}
+
+	status, err := store.LeakStatus(job.leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.ReadCheckpoint(job.leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 2 || c.line < stopAt || c.line >= lines || c != reached {
+		t.Fatalf("stopped leak has status %v and checkpoint %+v (worker reached %+v), want 2 and a line from %v", status, c, reached, stopAt)
+	}
+
+	testIngest(t, context.Background(), store)
+	testResumed(t, store, job.leakID, lines)
+}
+
+/*
+TestKillMidFile kills an ingest with SIGKILL in the middle of a leak and ingests again.
+The ingest killed is this test run again in a child process (TR4IL_TEST_KILL_DB set),
+it is killed once a checkpoint of the leak past line 1000 was committed.
+*/
+func TestKillMidFile(t *testing.T) {
+	const lines = 30000
+	if path := os.Getenv("TR4IL_TEST_KILL_DB"); path != "" {
+		// the child, killed by the test
+		testConfig(t, "-u", os.Getenv("TR4IL_TEST_KILL_DIR"), "-p", "leaks", "-b", "100", "-w", "1")
+		testIngest(t, context.Background(), testOpenStore(t, path))
+		return
+	}
+	if testing.Short() {
+		t.Skip("kill test skipped with -short")
+	}
+
+	root := t.TempDir()
+	path := filepath.Join(root, "creds.db")
+	testConfig(t, "-u", root, "-p", "leaks", "-b", "100")
+	testDump(t, filepath.Join(root, "leaks", "big"), "dump.txt", lines)
+
+	child := exec.Command(os.Args[0], "-test.run=^TestKillMidFile$")
+	child.Env = append(os.Environ(), "TR4IL_TEST_KILL_DB="+path, "TR4IL_TEST_KILL_DIR="+root)
+	err := child.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// kill it once it committed some of the leak, read with a read-only connection of our own
+	deadline := time.Now().Add(time.Minute)
+	for {
+		time.Sleep(5 * time.Millisecond)
+		var line int
+		if _, err := os.Stat(path); err == nil {
+			db, err := sql.Open(sqliteDriver(), "file:"+path+"?mode=ro")
+			if err == nil {
+				db.QueryRow("SELECT coalesce(max(lineoffset), 0) FROM leaks").Scan(&line)
+				db.Close()
+			}
+		}
+		if line >= 1000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			child.Process.Kill()
+			t.Fatal("the child did not commit any line in a minute")
+		}
+	}
+	child.Process.Kill()
+	child.Wait()
+
+	store := testOpenStore(t, path)
+	found, err := discoverLeaks(filepath.Join(root, "leaks"))
+	if err != nil || len(found) != 1 {
+		t.Fatalf("found %v leaks: %v", len(found), err)
+	}
+	leakID, err := store.LeakID(leakHashID(found[0].parent, found[0].name, found[0].file, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := store.LeakStatus(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := store.ReadCheckpoint(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 2 || c.line == 0 || c.line >= lines {
+		t.Fatalf("killed leak has status %v and checkpoint %+v, want 2 and a line in the middle", status, c)
+	}
+	t.Logf("killed at line %v of %v", c.line, lines)
+
+	testIngest(t, context.Background(), store)
+	testResumed(t, store, leakID, lines)
+}
+
+// the domains are written in lowercase, the same domain in another case is the same row
+func TestDomainsLowercase(t *testing.T) {
+	root := t.TempDir()
+	testConfig(t, "-u", root, "-p", "leaks")
+	store := testStore(t)
+	dir := filepath.Join(root, "leaks", "mixed")
+	err := os.MkdirAll(dir, 0750)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "dump.txt"), []byte("a@Example.COM:pw1\nb@example.com:pw2\nc@EXAMPLE.com:pw3\n"), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIngest(t, context.Background(), store)
+
+	var n int
+	var domain string
+	err = store.Meta().QueryRow("SELECT count(*), max(domain) FROM domains").Scan(&n, &domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || domain != "example.com" {
+		t.Errorf("%v domains (%q), want only example.com", n, domain)
+	}
+	if n := testCount(t, store, "identities"); n != 3 {
+		t.Errorf("%v identities, want 3", n)
+	}
+}
+
+/*
+FuzzProcessFile ingests a leak made of the fuzzed bytes, the seeds being the lines that
+go wrong with SQL built by hand (quotes, '; DROP), NUL bytes, broken UTF-8 and the like.
+Whatever the lines are, the leak has to be done, the database has to pass its integrity
+and foreign key checks and every line read has to be found in it once: as a sighting or a
+duplicate when it parsed, as a row of rejects when it did not.
+*/
+func FuzzProcessFile(f *testing.F) {
+	for _, seed := range []string{
+		"a@example.com:pw\nb@example.com:pw2\n",
+		"o'brien@example.com:it's'\n\"quoted\"@example.com:\"pw\"\n",
+		"x@example.com:'; DROP TABLE sightings; --\n'); DELETE FROM leaks; --@example.com:pw\n",
+		"nul\x00@example.com:p\x00w\n\x00\x00\x00\nc@example.com:pw\x00\n",
+		"bad\xff\xfe@example.com:\xc3\x28\r\nd@Example.COM:pw\r\n",
+		"email,password\n\"e@example.com\",\"p,w\"\n\"f@example.com\",\"\"\"\"\n",
+		"https://site.com/login:g@example.com:pw\n:\n@:\n::::\n\n",
+		"",
+		"\x00",
+		"h@example.com:" + strings.Repeat("y", 2000) + "\nh@example.com:pw\nh@example.com:pw\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, dump []byte) {
+		root := t.TempDir()
+		testConfig(t, "-u", root, "-p", "leaks", "-w", "1", "-b", "3", "-rejects", "table", "-retries", "0")
+		store := testStore(t)
+		dir := filepath.Join(root, "leaks", "fuzz")
+		err := os.MkdirAll(dir, 0750)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, "dump.txt"), dump, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		testIngest(t, context.Background(), store)
+
+		db := store.Meta()
+		var integrity string
+		err = db.QueryRow("PRAGMA integrity_check").Scan(&integrity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if integrity != "ok" {
+			t.Fatalf("integrity check: %s", integrity)
+		}
+		rows, err := db.Query("PRAGMA foreign_key_check")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows.Next() {
+			t.Error("foreign key check found rows pointing nowhere")
+		}
+		rows.Close()
+
+		leakID, err := store.LeakID(leakHashID("leaks", "fuzz", "dump.txt", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := store.LeakStatus(leakID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 3 {
+			t.Fatalf("leak has status %v, want 3 (done)", status)
+		}
+		lines := bytes.Count(dump, []byte("\n"))
+		if len(dump) > 0 && dump[len(dump)-1] != '\n' {
+			lines++
+		}
+		var parsed, duplicates, rejected int
+		err = db.QueryRow("SELECT parsed, duplicates, rejected FROM leaks WHERE id = ?", leakID).Scan(&parsed, &duplicates, &rejected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed+rejected > lines {
+			t.Errorf("%v lines parsed and %v rejected out of %v", parsed, rejected, lines)
+		}
+		if n := testCount(t, store, "sightings"); n+duplicates != parsed {
+			t.Errorf("%v sightings and %v duplicates, want the %v lines parsed", n, duplicates, parsed)
+		}
+		if n := testCount(t, store, "rejects"); n != rejected {
+			t.Errorf("%v rows in rejects, want the %v lines rejected", n, rejected)
+		}
+		if n := testCount(t, store, "leaks"); n != 1 {
+			t.Errorf("%v leaks, want the one of the dump", n)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+The writer is the only goroutine writing to the store while ingesting. Workers only
+parse their file and send what they found over the records channel; the writer puts it
+in the store inside a long lived transaction (StoreTx), the creds a batch of -b records
+at a time. The transaction is committed after every batch and at the end of every leak
+(after -bulktx batches with -bulk, see bulk.go), and the creds it had go to the Parquet
+files then, if there are some (-parquet).
+
+A write that fails rolls the whole transaction back, so the records of every leak in it
+are lost: those leaks are set to failed (4) with the error, in a transaction of their own,
+and the writer drops what comes after for them, their status included. The next ingest
+with -retry-failed reads them again from their last committed checkpoint.
+*/
+
+const (
+	recordCred   = iota // a parsed cred
+	recordReject        // a line rejected by the parser (-rejects table)
+	recordStart         // a worker started reading the leak
+	recordDone          // the leak was read, with its counts
+	recordFailed        // the leak could not be read, with the error and the number of tries
+)
+
+type record struct {
+	kind     int
+	identity identityRows // Domain is filled in by the writer
+	password passwordRows
+	sighting sightingRows // Identity and Password are found by the writer
+	domain   string
+	line     int
+	offset   int64 // end of the line in the (decompressed) file
+	reject   rejectRows
+	leakID   int
+	counts   leakCounts // counts of the leak up to this line
+	attempts int        // tries of a failed leak
+	failure  string     // error of a failed leak
+}
+
+// leakCounts are the line counts of a leak, the duplicates are counted by the writer
+type leakCounts struct {
+	parsed     int
+	duplicates int
+	rejected   int
+}
+
+/*
+checkpoint is how far a leak was committed: the creds of its lines up to byte offset
+(line line) are in the database. It is saved in the leaks table in the same transaction
+as the creds.
+*/
+type checkpoint struct {
+	offset int64
+	line   int
+	counts leakCounts
+}
+
+const (
+	writerReportEvery = 10 * time.Second // how often the throughput is logged
+	domainCacheSize   = 100000           // domains kept in the cache of the SQLite store, it is emptied when full
+)
+
+type writer struct {
+	store   Store
+	sink    *parquetSink // nil without -parquet
+	records chan record
+	done    chan struct{}
+
+	tx          StoreTx
+	inTx        int          // records in the current transaction
+	commitEvery int          // records in a transaction, -b or -bulktx batches of -b with -bulk
+	creds       []record     // creds of the transaction not written yet
+	rejects     []rejectRows // rejected lines of the transaction not written yet
+	written     []record     // creds written in the transaction, for the sink once it is committed
+
+	duplicates map[int]int        // leak id -> creds already in the database
+	progress   map[int]checkpoint // leak id -> last line written in the current transaction
+	txLeaks    map[int]bool       // leaks with records in the current transaction
+	failed     map[int]string     // leak id -> error, leaks whose records were lost in a rollback
+
+	lines    int
+	inserted int
+	start    time.Time
+}
+
+// startWriter starts the writer goroutine, close w.records to stop it and wait on w.done
+func startWriter(store Store, sink *parquetSink, buffer int) *writer {
+	w := &writer{
+		store:      store,
+		sink:       sink,
+		records:    make(chan record, buffer),
+		done:       make(chan struct{}),
+		duplicates: map[int]int{},
+		progress:   map[int]checkpoint{},
+		txLeaks:    map[int]bool{},
+		failed:     map[int]string{},
+		start:      time.Now(),
+	}
+	w.commitEvery = *BatchSize
+	if *BulkLoad {
+		w.commitEvery = *BatchSize * *BulkTx
+	}
+	go w.run()
+	return w
+}
+
+func (w *writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(writerReportEvery)
+	defer ticker.Stop()
+	lastLines := 0
+	lastInserted := 0
+	lastTime := time.Now()
+
+	for {
+		select {
+		case r, ok := <-w.records:
+			if !ok {
+				err := w.commit()
+				CheckErr(err, "Error", "Could not commit the last records")
+				elapsed := time.Since(w.start)
+				LoggWith(log.Fields{"lines": w.lines}, fmt.Sprintf("Writer done: %v new creds in %s (%.0f lines/s)", w.inserted, elapsed, float64(w.lines)/elapsed.Seconds()), "Info")
+				return
+			}
+			err := w.write(r)
+			CheckErr(err, "Error", "Could not write record, the leaks of the transaction are set to failed")
+
+		case now := <-ticker.C:
+			seconds := now.Sub(lastTime).Seconds()
+			rate := float64(w.lines-lastLines) / seconds
+			metricInsertRate.Set(float64(w.inserted-lastInserted) / seconds)
+			LoggWith(log.Fields{"lines": w.lines}, fmt.Sprintf("Writer: %.0f lines/s, %v new creds so far", rate, w.inserted), "Info")
+			lastLines = w.lines
+			lastInserted = w.inserted
+			lastTime = now
+		}
+	}
+}
+
+// begin opens the transaction if needed
+func (w *writer) begin() (err error) {
+	if w.tx != nil {
+		return nil
+	}
+	w.tx, err = w.store.Begin()
+	return err
+}
+
+/*
+flush writes the creds and the rejected lines waiting in the transaction. It is done
+before anything that needs them written: the counts of a leak, a commit.
+*/
+func (w *writer) flush() error {
+	if len(w.rejects) > 0 {
+		err := w.tx.WriteRejects(w.rejects)
+		w.rejects = w.rejects[:0]
+		if err != nil {
+			return err
+		}
+	}
+	if len(w.creds) == 0 {
+		return nil
+	}
+	start := time.Now()
+	duplicates, err := w.tx.WriteCreds(w.creds)
+	if err != nil {
+		return err
+	}
+	metricBatchSeconds.WithLabelValues("write").Observe(time.Since(start).Seconds())
+	known := 0
+	for leakID, n := range duplicates {
+		w.duplicates[leakID] += n
+		known += n
+	}
+	w.inserted += len(w.creds) - known
+	metricCreds.WithLabelValues("inserted").Add(float64(len(w.creds) - known))
+	metricCreds.WithLabelValues("duplicate").Add(float64(known))
+	if w.sink != nil {
+		w.written = append(w.written, w.creds...)
+	}
+	w.creds = w.creds[:0]
+	return nil
+}
+
+/*
+rollback drops the transaction and what was waiting in it, after err. The leaks that had
+records in it lost them, they are set to failed with err, see failLeak.
+*/
+func (w *writer) rollback(err error) {
+	if w.tx != nil {
+		CheckErr(w.tx.Rollback(), "Warn", "Could not roll back the transaction")
+	}
+	w.tx = nil
+	w.inTx = 0
+	w.creds = w.creds[:0]
+	w.rejects = w.rejects[:0]
+	w.written = w.written[:0]
+	w.progress = map[int]checkpoint{}
+	for leakID := range w.txLeaks {
+		w.failLeak(leakID, err)
+	}
+	w.txLeaks = map[int]bool{}
+}
+
+// failLeak sets the leak to failed with err, in a transaction of its own, the records that come after for it are dropped
+func (w *writer) failLeak(leakID int, err error) {
+	if _, ok := w.failed[leakID]; ok {
+		return
+	}
+	w.failed[leakID] = err.Error()
+	delete(w.duplicates, leakID)
+
+	tx, e := w.store.Begin()
+	if e == nil {
+		e = tx.SaveFailure(leakID, 0, "writer: "+err.Error())
+		if e != nil {
+			tx.Rollback()
+		} else {
+			e = tx.Commit()
+		}
+	}
+	CheckErrWith(log.Fields{"leak_id": leakID, "failure": err.Error()}, e, "Error", "Could not set the leak to failed, its status is wrong until it is read again")
+	if e == nil {
+		LoggWith(log.Fields{"leak_id": leakID, "error": err.Error()}, "Leak set to failed, records of it were lost in a rollback", "Error")
+	}
+}
+
+// commit saves the checkpoints of the leaks written in the transaction and commits it
+func (w *writer) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.flush()
+	if err != nil {
+		w.rollback(err)
+		return err
+	}
+	for leakID, c := range w.progress {
+		c.counts.duplicates = w.duplicates[leakID]
+		err := w.tx.SaveCheckpoint(leakID, c)
+		if err != nil {
+			// the creds committed without their checkpoint would be read again by a retry
+			CheckErrWith(log.Fields{"leak_id": leakID, "lines": c.line}, err, "Error", "Could not save the checkpoint of the leak")
+			w.rollback(err)
+			return err
+		}
+	}
+	w.progress = map[int]checkpoint{}
+	start := time.Now()
+	err = w.tx.Commit()
+	metricBatchSeconds.WithLabelValues("commit").Observe(time.Since(start).Seconds())
+	if err != nil {
+		// the transaction is over, nothing left to roll back
+		w.tx = nil
+		w.rollback(err)
+		return err
+	}
+	w.tx = nil
+	w.inTx = 0
+	w.txLeaks = map[int]bool{}
+	if w.sink != nil {
+		err = w.sink.Write(w.written)
+	}
+	w.written = w.written[:0]
+	return err
+}
+
+// leak is the id of the leak the record is about
+func (r record) leak() int {
+	switch r.kind {
+	case recordCred:
+		return r.sighting.Leak
+	case recordReject:
+		return r.reject.Leak
+	}
+	return r.leakID
+}
+
+func (w *writer) write(r record) (err error) {
+	if _, ok := w.failed[r.leak()]; ok {
+		// the leak lost records in a rollback, it stays failed
+		if r.kind == recordDone {
+			LoggWith(log.Fields{"leak_id": r.leakID}, "Leak read to the end but records of it were lost, it stays failed", "Warn")
+		}
+		return nil
+	}
+	err = w.begin()
+	if err != nil {
+		w.failLeak(r.leak(), err)
+		return err
+	}
+	w.txLeaks[r.leak()] = true
+
+	switch r.kind {
+	case recordCred:
+		w.lines++
+		w.creds = append(w.creds, r)
+		w.progress[r.sighting.Leak] = checkpoint{offset: r.offset, line: r.line, counts: r.counts}
+	case recordReject:
+		w.lines++
+		w.rejects = append(w.rejects, r.reject)
+	case recordStart:
+		if _, ok := w.duplicates[r.leakID]; !ok {
+			// a leak tried again keeps the duplicates counted by the tries before
+			w.duplicates[r.leakID] = r.counts.duplicates
+		}
+		err = w.tx.SetLeakStatus(r.leakID, 2)
+	case recordDone:
+		err = w.flush()
+		if err == nil {
+			counts := r.counts
+			counts.duplicates = w.duplicates[r.leakID]
+			err = w.tx.SaveCounts(r.leakID, counts)
+		}
+		if err == nil {
+			err = w.tx.SetLeakStatus(r.leakID, 3)
+		}
+		LoggWith(log.Fields{"leak_id": r.leakID, "lines": r.counts.parsed}, fmt.Sprintf("Leak done: %v duplicates, %v rejected", w.duplicates[r.leakID], r.counts.rejected), "Info")
+		delete(w.duplicates, r.leakID)
+		delete(w.progress, r.leakID)
+		if err != nil {
+			w.rollback(err)
+			return err
+		}
+		if *BulkLoad {
+			// the transaction goes on, the leaks are done when it is committed
+			return nil
+		}
+		return w.commit()
+	case recordFailed:
+		// the checkpoint of what was read is saved by the commit, -retry-failed goes on from there
+		err = w.flush()
+		if err == nil {
+			err = w.tx.SaveFailure(r.leakID, r.attempts, r.failure)
+		}
+		if err != nil {
+			delete(w.duplicates, r.leakID)
+			w.rollback(err)
+			return err
+		}
+		err = w.commit()
+		delete(w.duplicates, r.leakID)
+		return err
+	}
+	if err != nil {
+		w.rollback(err)
+		return err
+	}
+
+	w.inTx++
+	if w.inTx >= w.commitEvery {
+		return w.commit()
+	}
+	if w.inTx%*BatchSize == 0 {
+		return w.flush()
+	}
+	return nil
+}
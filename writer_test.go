@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingStore is a store whose transactions fail the next failWrites WriteCreds and failCheckpoints SaveCheckpoint
+type failingStore struct {
+	Store
+	failWrites      int
+	failCheckpoints int
+}
+
+type failingTx struct {
+	StoreTx
+	s *failingStore
+}
+
+var errDiskIO = errors.New("disk I/O error")
+
+func (s *failingStore) Begin() (StoreTx, error) {
+	tx, err := s.Store.Begin()
+	return failingTx{StoreTx: tx, s: s}, err
+}
+
+func (tx failingTx) WriteCreds(creds []record) (map[int]int, error) {
+	if tx.s.failWrites > 0 {
+		tx.s.failWrites--
+		return nil, errDiskIO
+	}
+	return tx.StoreTx.WriteCreds(creds)
+}
+
+func (tx failingTx) SaveCheckpoint(leakID int, c checkpoint) error {
+	if tx.s.failCheckpoints > 0 {
+		tx.s.failCheckpoints--
+		return errDiskIO
+	}
+	return tx.StoreTx.SaveCheckpoint(leakID, c)
+}
+
+// a write that fails loses the records of every leak in the transaction, they all have to end up failed and not done
+func TestWriterFailedWriteFailsLeaks(t *testing.T) {
+	testConfig(t, "-b", "100")
+	store := &failingStore{Store: testStore(t), failWrites: 1}
+	first := testLeak(t, store, "first.txt")
+	second := testLeak(t, store, "second.txt")
+	third := testLeak(t, store, "third.txt")
+
+	w := startWriter(store, nil, 10)
+	w.records <- record{kind: recordStart, leakID: first}
+	w.records <- record{kind: recordStart, leakID: second}
+	w.records <- testCred(first, 1, "a@example.com", "pw1")
+	w.records <- testCred(second, 1, "b@example.com", "pw2")
+	w.records <- record{kind: recordDone, leakID: first, counts: leakCounts{parsed: 1}} // the flush fails
+	w.records <- testCred(second, 2, "c@example.com", "pw3")
+	w.records <- record{kind: recordDone, leakID: second, counts: leakCounts{parsed: 2}}
+	w.records <- record{kind: recordStart, leakID: third}
+	w.records <- testCred(third, 1, "d@example.com", "pw4")
+	w.records <- record{kind: recordDone, leakID: third, counts: leakCounts{parsed: 1}}
+	close(w.records)
+	<-w.done
+
+	for _, id := range []int{first, second} {
+		status, err := store.LeakStatus(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 4 {
+			t.Errorf("leak %v has status %v, want 4 (failed)", id, status)
+		}
+		var failure string
+		err = store.Meta().QueryRow("SELECT error FROM leaks WHERE id = ?", id).Scan(&failure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(failure, errDiskIO.Error()) {
+			t.Errorf("leak %v has error %q, want the one of the write", id, failure)
+		}
+		if _, ok := w.failed[id]; !ok {
+			t.Errorf("leak %v is not in the failed leaks of the writer", id)
+		}
+	}
+
+	status, err := store.LeakStatus(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 3 {
+		t.Errorf("leak %v written after the failure has status %v, want 3 (done)", third, status)
+	}
+	if n := testCount(t, store, "sightings"); n != 1 {
+		t.Errorf("%v sightings, want only the one of the last leak", n)
+	}
+}
+
+// a checkpoint that cannot be saved rolls the transaction back, its creds are not committed without it
+func TestWriterFailedCheckpointFailsLeak(t *testing.T) {
+	testConfig(t, "-b", "100")
+	store := &failingStore{Store: testStore(t), failCheckpoints: 1}
+	leakID := testLeak(t, store, "dump.txt")
+
+	w := startWriter(store, nil, 10)
+	w.records <- record{kind: recordStart, leakID: leakID}
+	w.records <- testCred(leakID, 1, "a@example.com", "pw1")
+	w.records <- testCred(leakID, 2, "b@example.com", "pw2")
+	close(w.records) // the last commit saves the checkpoint
+	<-w.done
+
+	status, err := store.LeakStatus(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 4 {
+		t.Errorf("leak has status %v, want 4 (failed)", status)
+	}
+	c, err := store.ReadCheckpoint(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.line != 0 {
+		t.Errorf("checkpoint at line %v, want none", c.line)
+	}
+	if n := testCount(t, store, "sightings"); n != 0 {
+		t.Errorf("%v sightings committed without their checkpoint, want none", n)
+	}
+}
+
+// a cred SQLite refuses is an error of the write, not a line skipped with the checkpoint going past it
+func TestWriteCredsError(t *testing.T) {
+	testConfig(t, "-b", "100")
+	store := testStore(t)
+	leakID := testLeak(t, store, "dump.txt")
+	_, err := store.Meta().Exec("CREATE TRIGGER refuse BEFORE INSERT ON sightings WHEN NEW.line = 2 BEGIN SELECT RAISE(ABORT, 'refused'); END")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := startWriter(store, nil, 10)
+	w.records <- record{kind: recordStart, leakID: leakID}
+	for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		w.records <- testCred(leakID, i+1, email, "pw")
+	}
+	w.records <- record{kind: recordDone, leakID: leakID, counts: leakCounts{parsed: 3}}
+	close(w.records)
+	<-w.done
+
+	status, err := store.LeakStatus(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 4 {
+		t.Errorf("leak has status %v, want 4 (failed)", status)
+	}
+	c, err := store.ReadCheckpoint(leakID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.line != 0 {
+		t.Errorf("leak has its checkpoint at line %v, want it before the cred refused", c.line)
+	}
+	if n := testCount(t, store, "sightings"); n != 0 {
+		t.Errorf("%v sightings, want the transaction rolled back", n)
+	}
+}